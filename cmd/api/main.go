@@ -2,34 +2,307 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
 	"s3-analytics/internal/api"
 	"s3-analytics/internal/api/handlers"
+	"s3-analytics/internal/api/middleware"
 	"s3-analytics/internal/aws"
 	"s3-analytics/internal/config"
+	"s3-analytics/internal/lifecycle"
+	"s3-analytics/internal/logging"
+	"s3-analytics/internal/processor"
 	"s3-analytics/internal/services"
+	"s3-analytics/internal/telemetry"
 
+	smithymiddleware "github.com/aws/smithy-go/middleware"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		reconcile(os.Args[2:])
+		return
+	}
 
-	config := config.LoadConfig()
-	ctx := context.Background()
+	config, err := config.Load(os.Args[1:])
 
-	s3Client := aws.NewS3Client(ctx, config.Bucket)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	if config.PrintConfig {
+		if err := config.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	logging.SetLevel(config.Level())
+	logger := logging.NewStructuredLogger()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tracerProvider, err := telemetry.Setup(ctx, config.TraceExporter, "s3-analytics-api")
+
+	if err != nil {
+		log.Fatalf("Unable to set up tracing: %v", err)
+	}
+
+	prometheusMetrics, awsOptions := newPrometheusMetrics(config)
+
+	var clients *aws.ClientFactory
+
+	if usesAWS(config) {
+		clients, err = aws.NewClientFactory(ctx, config.AWS, awsOptions...)
+
+		if err != nil {
+			log.Fatalf("Unable to set up AWS clients: %v", err)
+		}
+	}
+
+	storage, metadata := newBackends(config, clients)
+	metrics := newMetrics(config, clients, prometheusMetrics)
+	// Closed on shutdown; metadata itself may be wrapped below.
+	metadataStore := metadata
+
+	if pipeline, ok := metrics.(services.PipelineMetrics); ok {
+		metadata = services.NewInstrumentedMetadataStore(metadata, pipeline)
+	}
+
+	// Background work outlives the signal until in-flight requests, which
+	// may still queue uploads for the worker, have drained.
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	// The stores are only closed once background work has returned.
+	var backgroundWork sync.WaitGroup
+	runInBackground := func(run func(context.Context)) {
+		backgroundWork.Add(1)
+		go func() {
+			defer backgroundWork.Done()
+			run(background)
+		}()
+	}
+
+	fileProcessor := processor.NewProcessor(storage, metadata)
+	fileProcessor.MaxUploadSize = config.MaxUploadSize
+
+	var notifier services.UploadNotifier
+	if config.ProcessorWorker {
+		worker := processor.NewWorker(fileProcessor, 100)
+		runInBackground(worker.Run)
+		notifier = worker
+	}
+
+	if config.PurgeInterval > 0 {
+		purger := lifecycle.NewPurger(storage, metadata, config.PurgeGracePeriod)
+		runInBackground(func(ctx context.Context) { purger.Run(ctx, config.PurgeInterval) })
+	}
+
+	if config.ReconcileInterval > 0 {
+		reconciler := newReconciler(config, storage, metadata, fileProcessor)
+		runInBackground(func(ctx context.Context) { reconciler.Run(ctx, config.ReconcileInterval) })
+	}
+
+	uploadHandler := handlers.NewUploadHandler(storage, metadata, notifier)
+	filesHander := handlers.NewFilesHandler(storage, metadata)
+	tusHandler := handlers.NewTusHandler(storage, metadata, notifier)
+	healthHandler := handlers.NewHealthHandler(storage, metadata)
+
+	uploadHandler.MaxUploadSize = config.MaxUploadSize
+	idempotency := newIdempotencyStore(config, clients)
+	uploadHandler.Idempotency = idempotency
+	uploadHandler.IdempotencyTTL = config.IdempotencyTTL
+	uploadHandler.IdempotencyLease = config.IdempotencyLease
+	tusHandler.MaxUploadSize = config.MaxUploadSize
+
+	server := gin.New()
+	server.Use(
+		gin.Recovery(),
+		otelgin.Middleware("s3-analytics-api"),
+		middleware.Trace(logger),
+		middleware.Metrics(metrics),
+	)
+	api.RegisterRoutes(server, uploadHandler, filesHander, tusHandler, healthHandler)
+
+	if prometheusMetrics != nil {
+		server.GET("/metrics", gin.WrapH(prometheusMetrics.Handler()))
+	}
+
+	httpServer := &http.Server{
+		Addr:              config.ListenAddress,
+		Handler:           server,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+
+	serverLog := logger.With("component", "server")
+	serverLog.Info("Shutting down.", "timeout", config.ShutdownTimeout.String())
+
+	healthHandler.Drain()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		serverLog.Error("In-flight requests did not finish in time.", "error", err)
+	}
+
+	stopBackground()
+	backgroundWork.Wait()
+
+	closeStore(serverLog, "metadata", metadataStore)
+	closeStore(serverLog, "idempotency", idempotency)
+
+	// Flushing gets its own deadline so a slow drain does not lose metrics.
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFlush()
+
+	if closer, ok := metrics.(services.MetricsCloser); ok {
+		if err := closer.Close(flushCtx); err != nil {
+			serverLog.Error("Failed to flush metrics.", "error", err)
+		}
+	}
+
+	if err := tracerProvider.Shutdown(flushCtx); err != nil {
+		serverLog.Error("Failed to flush traces.", "error", err)
+	}
+
+	serverLog.Info("Shutdown complete.")
+}
+
+// closeStore closes store if it holds resources, such as a Bolt database.
+func closeStore(log *slog.Logger, name string, store any) {
+	closer, ok := store.(io.Closer)
+
+	if !ok {
+		return
+	}
+
+	if err := closer.Close(); err != nil {
+		log.Error("Failed to close store.", "store", name, "error", err)
+	}
+}
+
+// newPrometheusMetrics returns the Prometheus recorder when cfg.MetricsSink
+// includes it, along with the middleware that times AWS calls for it.
+func newPrometheusMetrics(cfg *config.Config) (*services.PrometheusMetrics, []func(*smithymiddleware.Stack) error) {
+	if cfg.MetricsSink != config.MetricsSinkPrometheus && cfg.MetricsSink != config.MetricsSinkBoth {
+		return nil, nil
+	}
+
+	prometheusMetrics := services.NewPrometheusMetrics()
+	return prometheusMetrics, []func(*smithymiddleware.Stack) error{prometheusMetrics.AWSMiddleware()}
+}
+
+// usesAWS reports whether cfg needs any AWS client.
+func usesAWS(cfg *config.Config) bool {
+	return cfg.Backend == config.BackendAWS || cfg.MetricsSink == config.MetricsSinkCloudWatch || cfg.MetricsSink == config.MetricsSinkBoth
+}
+
+// newBackends builds the storage and metadata implementations selected by
+// cfg.Backend. clients is nil unless usesAWS.
+func newBackends(cfg *config.Config, clients *aws.ClientFactory) (services.BlobStore, services.MetadataStore) {
+	switch cfg.Backend {
+	case config.BackendMemory:
+		return services.NewMemoryBlobStore(), services.NewMemoryMetadataStore()
+	case config.BackendLocal:
+		storage, err := services.NewLocalBlobStore(filepath.Join(cfg.DataDir, "blobs"))
+		if err != nil {
+			log.Fatalf("Unable to create local blob store: %v", err)
+		}
+
+		metadata, err := services.NewBoltMetadataStore(filepath.Join(cfg.DataDir, "metadata.db"))
+		if err != nil {
+			log.Fatalf("Unable to open local metadata store: %v", err)
+		}
+
+		return storage, metadata
+	}
+
+	s3Client := clients.NewS3Client(cfg.Bucket)
 	s3Service := services.NewS3Service(s3Client)
 
-	dynamoDBClient := aws.NewDynamoDBClient(ctx, config.TableName)
+	dynamoDBClient := clients.NewDynamoDBClient(cfg.TableName)
 	dynamoDBService := services.NewDynamoDBService(dynamoDBClient)
 
-	cloudWatchClient := aws.NewCloudWatchClient(ctx)
-	cloudWatchService := services.NewCloudWatchService(cloudWatchClient)
+	return s3Service, dynamoDBService
+}
+
+// newIdempotencyStore builds the store for Idempotency-Key uploads. It is nil
+// on the aws backend without an idempotency table.
+func newIdempotencyStore(cfg *config.Config, clients *aws.ClientFactory) services.IdempotencyStore {
+	switch cfg.Backend {
+	case config.BackendMemory:
+		return services.NewMemoryIdempotencyStore()
+	case config.BackendLocal:
+		store, err := services.NewBoltIdempotencyStore(filepath.Join(cfg.DataDir, "idempotency.db"))
+		if err != nil {
+			log.Fatalf("Unable to open local idempotency store: %v", err)
+		}
+
+		return store
+	}
+
+	if cfg.IdempotencyTableName == "" {
+		return nil
+	}
+
+	return services.NewDynamoDBIdempotencyStore(clients.NewDynamoDBClient(cfg.IdempotencyTableName))
+}
+
+// newMetrics builds the recorder for cfg.MetricsSink. Without a sink the
+// memory backend keeps metrics in memory and the local backend logs them.
+func newMetrics(cfg *config.Config, clients *aws.ClientFactory, prometheusMetrics *services.PrometheusMetrics) services.MetricsRecorder {
+	switch cfg.MetricsSink {
+	case config.MetricsSinkCloudWatch:
+		return newCloudWatchMetrics(cfg, clients)
+	case config.MetricsSinkEMF:
+		return services.NewEMFMetrics()
+	case config.MetricsSinkPrometheus:
+		return prometheusMetrics
+	case config.MetricsSinkBoth:
+		return services.NewMultiMetrics(newCloudWatchMetrics(cfg, clients), prometheusMetrics)
+	}
+
+	if cfg.Backend == config.BackendMemory {
+		return services.NewMemoryMetrics()
+	}
+	return services.NewLogMetrics()
+}
 
-	uploadHandler := handlers.NewUploadHandler(s3Service, dynamoDBService, cloudWatchService)
-	filesHander := handlers.NewFilesHandler(dynamoDBService, cloudWatchService)
+func newCloudWatchMetrics(cfg *config.Config, clients *aws.ClientFactory) *services.CloudWatchService {
+	cloudWatchClient := clients.NewCloudWatchClient()
 
-	server := gin.Default()
-	api.RegisterRoutes(server, uploadHandler, filesHander)
-	server.Run(":8080")
-}
\ No newline at end of file
+	return services.NewCloudWatchService(cloudWatchClient, services.CloudWatchOptions{
+		FlushInterval: cfg.MetricsFlushInterval,
+		QueueSize:     cfg.MetricsQueueSize,
+	}, logging.NewStructuredLogger().With("component", "metrics"))
+}
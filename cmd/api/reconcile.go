@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"s3-analytics/internal/aws"
+	"s3-analytics/internal/config"
+	"s3-analytics/internal/lifecycle"
+	"s3-analytics/internal/logging"
+	"s3-analytics/internal/processor"
+	"s3-analytics/internal/services"
+)
+
+// reconcile runs `api reconcile`: one reconciliation of the bucket with the
+// metadata table, with its summary printed to stdout. It takes the same
+// settings as the server, e.g. `api reconcile --reconcile.repair`, and exits
+// non-zero when a scan or repair fails.
+func reconcile(args []string) {
+	config, err := config.Load(args)
+
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	logging.SetLevel(config.Level())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var clients *aws.ClientFactory
+
+	if usesAWS(config) {
+		clients, err = aws.NewClientFactory(ctx, config.AWS)
+
+		if err != nil {
+			log.Fatalf("Unable to set up AWS clients: %v", err)
+		}
+	}
+
+	storage, metadata := newBackends(config, clients)
+	defer closeStore(slog.Default(), "metadata", metadata)
+	fileProcessor := processor.NewProcessor(storage, metadata)
+	fileProcessor.MaxUploadSize = config.MaxUploadSize
+
+	reconciler := newReconciler(config, storage, metadata, fileProcessor)
+
+	report, err := reconciler.ReconcileOnce(ctx)
+
+	if report != nil {
+		if err := report.WriteSummary(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err != nil {
+		log.Fatalf("Reconciliation failed: %v", err)
+	}
+}
+
+// newReconciler builds a Reconciler with the reconcile.* settings.
+func newReconciler(cfg *config.Config, storage services.BlobStore, metadata services.MetadataStore, p *processor.Processor) *lifecycle.Reconciler {
+	reconciler := lifecycle.NewReconciler(storage, metadata, p)
+	reconciler.StuckAfter = cfg.ReconcileStuckAfter
+	reconciler.AbandonAfter = cfg.ReconcileAbandonAfter
+	reconciler.Repair = cfg.ReconcileRepair
+	reconciler.Backfill = cfg.ReconcileBackfill
+
+	return reconciler
+}
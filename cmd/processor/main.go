@@ -0,0 +1,80 @@
+// Lambda entry point for the file processor, triggered by the EventBridge
+// rule on S3 "Object Created" events under raw/.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+
+	"s3-analytics/internal/aws"
+	"s3-analytics/internal/config"
+	"s3-analytics/internal/logging"
+	"s3-analytics/internal/processor"
+	"s3-analytics/internal/services"
+	"s3-analytics/internal/telemetry"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// objectCreatedDetail is the part of the S3 EventBridge event we use.
+type objectCreatedDetail struct {
+	Bucket struct {
+		Name string `json:"name"`
+	} `json:"bucket"`
+	Object struct {
+		Key string `json:"key"`
+	} `json:"object"`
+}
+
+func main() {
+	config, err := config.Load(os.Args[1:])
+
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	logging.SetLevel(config.Level())
+	ctx := context.Background()
+
+	tracerProvider, err := telemetry.Setup(ctx, config.TraceExporter, "s3-analytics-processor")
+
+	if err != nil {
+		log.Fatalf("Unable to set up tracing: %v", err)
+	}
+
+	clients, err := aws.NewClientFactory(ctx, config.AWS)
+
+	if err != nil {
+		log.Fatalf("Unable to set up AWS clients: %v", err)
+	}
+
+	s3Service := services.NewS3Service(clients.NewS3Client(config.Bucket))
+	dynamoDBService := services.NewDynamoDBService(clients.NewDynamoDBClient(config.TableName))
+	p := processor.NewProcessor(s3Service, dynamoDBService)
+	p.MaxUploadSize = config.MaxUploadSize
+
+	lambda.Start(func(ctx context.Context, event events.EventBridgeEvent) error {
+		var detail objectCreatedDetail
+
+		if err := json.Unmarshal(event.Detail, &detail); err != nil {
+			return err
+		}
+
+		err := p.Process(ctx, detail.Object.Key)
+
+		// The execution environment may be frozen once we return.
+		tracerProvider.ForceFlush(ctx)
+
+		// Retrying cannot fix a key without a file id.
+		if errors.Is(err, processor.ErrNoFileID) {
+			return nil
+		}
+
+		return err
+	})
+}
@@ -19,6 +19,9 @@ type DeploymentStackProps struct {
 	awscdk.StackProps
 	TableName string
 	BucketName string
+	// IdempotencyTableName, when set, adds the table the API keeps
+	// Idempotency-Key uploads in.
+	IdempotencyTableName string
 }
 
 func NewDeploymentStack(scope constructs.Construct, id string, props *DeploymentStackProps) awscdk.Stack {
@@ -61,12 +64,38 @@ func NewDeploymentStack(scope constructs.Construct, id string, props *Deployment
 		},
 	})
 
-	// Lambda processor
+	// Serves GET /files: one partition per processing state, newest last
+	table.AddGlobalSecondaryIndex(&awsdynamodb.GlobalSecondaryIndexPropsV2{
+		IndexName: jsii.String("StateCreatedAtIndex"),
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("processingState"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		SortKey: &awsdynamodb.Attribute{
+			Name: jsii.String("createdAt"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+	})
+
+	if props.IdempotencyTableName != "" {
+		// Records expire through TTL once the API no longer needs them
+		awsdynamodb.NewTableV2(stack, jsii.String("IdempotencyTable"), &awsdynamodb.TablePropsV2{
+			TableName: jsii.String(props.IdempotencyTableName),
+			PartitionKey: &awsdynamodb.Attribute{
+				Name: jsii.String("idempotencyKey"),
+				Type: awsdynamodb.AttributeType_STRING,
+			},
+			TimeToLiveAttribute: jsii.String("expiresAt"),
+		})
+	}
+
+	// Lambda processor, built from ../cmd/processor by `make processor-lambda`
 	lambda := awslambda.NewFunction(stack, jsii.String("ProcessLambda"), &awslambda.FunctionProps{
 		FunctionName: jsii.String("ProcessLambda"),
-		Runtime: awslambda.Runtime_PYTHON_3_12(),
-		Handler: jsii.String("processor.lambda_handler"),
-		Code:    awslambda.Code_FromAsset(jsii.String("../lambdas/file_processor"), nil),
+		Runtime: awslambda.Runtime_PROVIDED_AL2023(),
+		Architecture: awslambda.Architecture_ARM_64(),
+		Handler: jsii.String("bootstrap"),
+		Code:    awslambda.Code_FromAsset(jsii.String("../build/processor"), nil),
 		Timeout: awscdk.Duration_Seconds(jsii.Number(120)),
 		Environment: &map[string]*string{
 			"TABLE_NAME": table.TableName(),
@@ -115,6 +144,7 @@ func main() {
 		},
 		BucketName: os.Getenv("BUCKET_NAME"),
 		TableName: os.Getenv("TABLE_NAME"),
+		IdempotencyTableName: os.Getenv("IDEMPOTENCY_TABLE_NAME"),
 	})
 
 	app.Synth(nil)
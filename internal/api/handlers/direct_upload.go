@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"s3-analytics/internal/api/middleware"
+	"s3-analytics/internal/services"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultPresignExpiry is how long presigned upload URLs stay valid.
+	DefaultPresignExpiry = 15 * time.Minute
+	// maxSinglePutSize is S3's limit for one PutObject; larger uploads must
+	// use multipart.
+	maxSinglePutSize = 5 << 30
+)
+
+type createUploadRequest struct {
+	Filename string `json:"filename" binding:"required"`
+	// Size is the declared size in bytes. It is required for multipart
+	// uploads and checked against the stored object on completion.
+	Size      int64 `json:"size"`
+	Multipart bool  `json:"multipart"`
+}
+
+type presignedPart struct {
+	PartNumber int32 `json:"partNumber"`
+	*services.PresignedRequest
+}
+
+type completeUploadRequest struct {
+	Parts []services.CompletedPart `json:"parts"`
+}
+
+// CreateUpload starts a direct-to-storage upload. It creates the metadata
+// record in the pending_upload state and returns either one presigned PUT or
+// one presigned request per multipart part.
+func (h *UploadHandler) CreateUpload(context *gin.Context) {
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
+
+	presigner, ok := h.Storage.(services.Presigner)
+	multipartStore, isMultipart := h.Storage.(services.MultipartStore)
+
+	if !ok || !isMultipart {
+		writeProblem(context, http.StatusNotImplemented, "Direct uploads are not supported by this storage backend.")
+		return
+	}
+
+	var req createUploadRequest
+
+	if err := context.ShouldBindJSON(&req); err != nil {
+		log.Error("Invalid upload request.", "error", err)
+		writeProblem(context, http.StatusUnprocessableEntity, "Invalid upload request: "+err.Error())
+		return
+	}
+
+	// Keys are raw/<id>-<filename>; a filename must not add path segments.
+	req.Filename = path.Base(req.Filename)
+
+	if req.Filename == "/" || req.Filename == "." || req.Filename == ".." {
+		writeProblem(context, http.StatusUnprocessableEntity, "Invalid upload request: filename is not valid.")
+		return
+	}
+
+	multipart := req.Multipart || req.Size > maxSinglePutSize
+
+	if req.Size < 0 || (multipart && req.Size == 0) {
+		writeProblem(context, http.StatusUnprocessableEntity, "Invalid upload request: size must be positive for multipart uploads.")
+		return
+	}
+
+	if h.MaxUploadSize > 0 && req.Size > h.MaxUploadSize {
+		writeProblem(context, http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload exceeds the maximum size of %d bytes.", h.MaxUploadSize))
+		return
+	}
+
+	expiry := h.PresignExpiry
+	if expiry == 0 {
+		expiry = DefaultPresignExpiry
+	}
+
+	id := uuid.NewString()
+	key := services.RawKey(id, req.Filename)
+	objectMetadata := services.ObjectMetadata(ctx, middleware.TraceID(context))
+	response := gin.H{
+		"id":        id,
+		"traceId":   middleware.TraceID(context),
+		"key":       key,
+		"state":     services.StatePendingUpload,
+		"expiresAt": time.Now().Add(expiry).UTC(),
+	}
+
+	metadata := services.FileMetadata{
+		ID:              id,
+		Filename:        req.Filename,
+		Size:            req.Size,
+		ProcessingState: services.StatePendingUpload,
+		CreatedAt:       time.Now().UTC(),
+		TraceID:         middleware.TraceID(context),
+	}
+
+	if multipart {
+		partSize := partSizeFor(req.Size)
+		uploadID, err := multipartStore.CreateMultipartUpload(ctx, key, objectMetadata)
+
+		if err != nil {
+			log.Error("Create multipart upload failed.", "error", err)
+			writeError(context, err, "Upload creation failed.")
+			return
+		}
+
+		count := int32((req.Size + partSize - 1) / partSize)
+		parts := make([]presignedPart, 0, count)
+
+		for n := int32(1); n <= count; n++ {
+			signed, err := presigner.PresignUploadPart(ctx, key, uploadID, n, expiry)
+
+			if err != nil {
+				log.Error("Presigning upload part failed.", "error", err)
+				abortMultipartUpload(ctx, log, multipartStore, key, uploadID)
+				writeError(context, err, "Upload creation failed.")
+				return
+			}
+
+			parts = append(parts, presignedPart{PartNumber: n, PresignedRequest: signed})
+		}
+
+		metadata.UploadID = uploadID
+		response["uploadId"] = uploadID
+		response["partSize"] = partSize
+		response["parts"] = parts
+	} else {
+		signed, err := presigner.PresignPutObject(ctx, key, objectMetadata, expiry)
+
+		if err != nil {
+			log.Error("Presigning upload failed.", "error", err)
+			writeError(context, err, "Upload creation failed.")
+			return
+		}
+
+		response["upload"] = signed
+	}
+
+	if err := h.Metadata.CreateItem(ctx, &metadata); err != nil {
+		log.Error("File metadata record create failed.", "error", err)
+		if metadata.UploadID != "" {
+			abortMultipartUpload(ctx, log, multipartStore, key, metadata.UploadID)
+		}
+		writeError(context, err, "Metadata record creation failed.")
+		return
+	}
+
+	log.Info("Direct upload created.", "file_id", id, "multipart", multipart)
+
+	context.JSON(http.StatusCreated, response)
+}
+
+// CompleteUpload finishes a direct upload: it completes the multipart upload
+// if there is one, checks the object with HeadObject and moves the record
+// from pending_upload to uploaded.
+func (h *UploadHandler) CompleteUpload(context *gin.Context) {
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
+
+	fileId := context.Param("id")
+
+	var req completeUploadRequest
+
+	if context.Request.ContentLength != 0 {
+		if err := context.ShouldBindJSON(&req); err != nil {
+			writeProblem(context, http.StatusUnprocessableEntity, "Invalid completion request: "+err.Error())
+			return
+		}
+	}
+
+	file, err := h.Metadata.GetFileById(ctx, fileId)
+
+	if err != nil {
+		log.Error("Failed to retrieve file metadata.", "error", err)
+		writeError(context, err, fmt.Sprintf("Failed to retrieve file metadata %s.", fileId))
+		return
+	}
+
+	// The processor enforces the size limits when it sees the object first.
+	if file.ProcessingState == services.StateQuarantined {
+		writeProblem(context, http.StatusConflict, fmt.Sprintf("Upload was refused: %s", file.LastError))
+		return
+	}
+
+	if file.ProcessingState != services.StatePendingUpload {
+		// Completing twice, or after the processor already ran, is not an error.
+		context.JSON(http.StatusOK, gin.H{"id": fileId, "state": file.ProcessingState, "traceId": middleware.TraceID(context), "message": "Upload already completed."})
+		return
+	}
+
+	key := services.RawKey(file.ID, file.Filename)
+
+	if file.UploadID != "" {
+		multipartStore, ok := h.Storage.(services.MultipartStore)
+
+		if !ok || len(req.Parts) == 0 {
+			writeProblem(context, http.StatusUnprocessableEntity, "Invalid completion request: parts are required for multipart uploads.")
+			return
+		}
+
+		err := multipartStore.CompleteMultipartUpload(ctx, key, file.UploadID, req.Parts)
+
+		// A previous attempt may have completed the upload already; the
+		// HeadObject below tells whether the object is there.
+		if err != nil && !errors.Is(err, services.ErrNotFound) {
+			log.Error("Complete multipart upload failed.", "error", err)
+			writeError(context, err, "Upload completion failed.")
+			return
+		}
+	}
+
+	head, err := h.Storage.HeadObject(ctx, key)
+
+	if err != nil {
+		log.Error("Uploaded object not found.", "error", err)
+		if errors.Is(err, services.ErrNotFound) {
+			writeProblem(context, http.StatusConflict, "Uploaded object not found.")
+		} else {
+			writeError(context, err, "Uploaded object could not be checked.")
+		}
+		return
+	}
+
+	// A single presigned PUT does not bind the size, so check it here. A
+	// rejected upload cannot be completed later, so it is discarded.
+	if h.MaxUploadSize > 0 && head.Size > h.MaxUploadSize {
+		h.discardUpload(ctx, log, file.ID, key)
+		writeProblem(context, http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload exceeds the maximum size of %d bytes.", h.MaxUploadSize))
+		return
+	}
+
+	if file.Size > 0 && head.Size != file.Size {
+		h.discardUpload(ctx, log, file.ID, key)
+		writeProblem(context, http.StatusConflict, fmt.Sprintf("Uploaded object size does not match: declared %d bytes, stored %d.", file.Size, head.Size))
+		return
+	}
+
+	update := services.Transition(services.StatePendingUpload, services.StateUploaded)
+	update.Size = &head.Size
+	update.UploadID = awssdk.String("")
+
+	err = h.Metadata.UpdateItem(ctx, fileId, update)
+
+	// The processor may have finished first; leave its state in place.
+	if err != nil && !errors.Is(err, services.ErrStateConflict) {
+		log.Error("File metadata update failed.", "error", err)
+		writeError(context, err, "Metadata update failed.")
+		return
+	}
+
+	if h.Notifier != nil {
+		h.Notifier.NotifyUploaded(ctx, key)
+	}
+
+	log.Info("Direct upload completed.", "file_id", fileId)
+
+	context.JSON(http.StatusOK, gin.H{
+		"traceId": middleware.TraceID(context),
+		"id":      fileId,
+		"key":     key,
+		"state":   services.StateUploaded,
+		"message": "Upload completed.",
+	})
+}
+
+// abortMultipartUpload aborts a multipart upload that will never be
+// completed. Like discardUpload it runs detached from the request; a failure
+// is logged, since the parts keep costing storage until someone aborts it.
+func abortMultipartUpload(ctx context.Context, log *slog.Logger, store services.MultipartStore, key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	if err := store.AbortMultipartUpload(ctx, key, uploadID); err != nil {
+		log.Error("Failed to abort multipart upload.", "key", key, "upload_id", uploadID, "error", err)
+	}
+}
+
+// deleteOrphanedObject deletes an object whose record could not be written.
+// Like abortMultipartUpload it runs detached from the request and logs a
+// failure.
+func deleteOrphanedObject(ctx context.Context, log *slog.Logger, store services.BlobStore, key string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	if err := store.DeleteObject(ctx, key); err != nil {
+		log.Error("Failed to delete orphaned object.", "key", key, "error", err)
+	}
+}
+
+// partSizeFor picks the smallest part size at or above the default that keeps
+// size within S3's part limit.
+func partSizeFor(size int64) int64 {
+	partSize := int64(services.DefaultPartSize)
+	if minimum := (size + services.MaxUploadParts - 1) / services.MaxUploadParts; minimum > partSize {
+		partSize = minimum
+	}
+	return partSize
+}
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"s3-analytics/internal/api/middleware"
+	"s3-analytics/internal/services"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultDownloadExpiry is how long presigned download URLs stay valid.
+const DefaultDownloadExpiry = 5 * time.Minute
+
+// errRangeNotSatisfiable is returned by parseRange for ranges outside the object.
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// GetFileContent streams the raw upload, honouring a single-range Range
+// header, or redirects to a presigned URL with ?redirect=presigned.
+func (h *FilesHandler) GetFileContent(context *gin.Context) {
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
+
+	fileId := context.Param("id")
+
+	file, err := h.Metadata.GetFileById(ctx, fileId)
+
+	if err != nil {
+		log.Error("Failed to retrieve file metadata.", "error", err)
+		writeError(context, err, fmt.Sprintf("Failed to retrieve file metadata %s.", fileId))
+		return
+	}
+
+	if file.Deleted() {
+		writeProblem(context, http.StatusNotFound, fmt.Sprintf("File %s not found.", fileId))
+		return
+	}
+
+	if file.ProcessingState == services.StatePendingUpload {
+		writeProblem(context, http.StatusConflict, fmt.Sprintf("File %s has not finished uploading.", fileId))
+		return
+	}
+
+	if file.ProcessingState == services.StateQuarantined {
+		writeProblem(context, http.StatusConflict, fmt.Sprintf("File %s is quarantined: %s", fileId, file.LastError))
+		return
+	}
+
+	if !h.serveObject(context, file.RawObjectKey(), file.Filename) {
+		return
+	}
+
+	log.Info("File content served.", "file_id", fileId, "status", context.Writer.Status())
+}
+
+// GetProcessedContent returns the processed JSON summary for a file.
+func (h *FilesHandler) GetProcessedContent(context *gin.Context) {
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
+
+	fileId := context.Param("id")
+
+	file, err := h.Metadata.GetFileById(ctx, fileId)
+
+	if err != nil {
+		log.Error("Failed to retrieve file metadata.", "error", err)
+		writeError(context, err, fmt.Sprintf("Failed to retrieve file metadata %s.", fileId))
+		return
+	}
+
+	if file.Deleted() {
+		writeProblem(context, http.StatusNotFound, fmt.Sprintf("File %s not found.", fileId))
+		return
+	}
+
+	if file.ProcessedKey == "" {
+		writeProblem(context, http.StatusConflict, fmt.Sprintf("File %s has not been processed yet; it is %s.", fileId, file.ProcessingState))
+		return
+	}
+
+	if !h.serveObject(context, file.ProcessedKey, "") {
+		return
+	}
+
+	log.Info("Processed content served.", "file_id", fileId)
+}
+
+// serveObject writes key to the response, or a presigned redirect when asked
+// for. filename, if set, is offered as the attachment name. It reports
+// whether the request was served successfully.
+func (h *FilesHandler) serveObject(context *gin.Context, key, filename string) bool {
+	ctx := context.Request.Context()
+	if context.Query("redirect") == "presigned" {
+		return h.redirectPresigned(context, key, filename)
+	}
+
+	info, err := h.Storage.HeadObject(ctx, key)
+
+	if err != nil {
+		writeError(context, err, "Stored object not found.")
+		return false
+	}
+
+	etag := `"` + info.ETag + `"`
+	context.Header("ETag", etag)
+	context.Header("Accept-Ranges", "bytes")
+	context.Header("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+
+	if filename != "" {
+		context.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+
+	if match := context.GetHeader("If-None-Match"); match != "" && (match == etag || match == "*") {
+		context.Status(http.StatusNotModified)
+		return true
+	}
+
+	offset, length, partial := int64(0), info.Size, false
+	rangeHeader := context.GetHeader("Range")
+
+	// If-Range asks for the whole object when it has changed since.
+	if ifRange := context.GetHeader("If-Range"); ifRange != "" && ifRange != etag {
+		rangeHeader = ""
+	}
+
+	if rangeHeader != "" {
+		offset, length, err = parseRange(rangeHeader, info.Size)
+
+		if errors.Is(err, errRangeNotSatisfiable) {
+			context.Header("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			context.Status(http.StatusRequestedRangeNotSatisfiable)
+			return false
+		}
+
+		// Ranges we do not understand, such as multiple ranges, get the whole object.
+		partial = err == nil
+
+		if !partial {
+			offset, length = 0, info.Size
+		}
+	}
+
+	var body io.ReadCloser
+
+	if partial {
+		body, err = h.Storage.GetObjectRange(ctx, key, offset, length)
+	} else {
+		body, _, err = h.Storage.GetObject(ctx, key)
+	}
+
+	if err != nil {
+		writeError(context, err, "Failed to read stored object.")
+		return false
+	}
+
+	defer body.Close()
+
+	status := http.StatusOK
+	headers := map[string]string{}
+
+	if partial {
+		status = http.StatusPartialContent
+		headers["Content-Range"] = fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size)
+	}
+
+	context.DataFromReader(status, length, info.ContentType, body, headers)
+	return true
+}
+
+func (h *FilesHandler) redirectPresigned(context *gin.Context, key, filename string) bool {
+	ctx := context.Request.Context()
+	presigner, ok := h.Storage.(services.Presigner)
+
+	if !ok {
+		writeProblem(context, http.StatusNotImplemented, "Presigned downloads are not supported by this storage backend.")
+		return false
+	}
+
+	expiry := h.DownloadExpiry
+	if expiry == 0 {
+		expiry = DefaultDownloadExpiry
+	}
+
+	signed, err := presigner.PresignGetObject(ctx, key, filename, expiry)
+
+	if err != nil {
+		writeError(context, err, "Failed to presign download.")
+		return false
+	}
+
+	context.Header("Location", signed.URL)
+	context.JSON(http.StatusTemporaryRedirect, gin.H{
+		"traceId":   middleware.TraceID(context),
+		"url":       signed.URL,
+		"expiresAt": time.Now().Add(expiry).UTC(),
+	})
+	return true
+}
+
+// parseRange parses a single "bytes=" range against an object of size bytes
+// and returns the offset and length it covers.
+func parseRange(header string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range %q", header)
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+
+	// Suffix range: the last N bytes.
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+
+		if n == 0 || size == 0 {
+			return 0, 0, errRangeNotSatisfiable
+		}
+
+		n = min(n, size)
+		return size - n, n, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+
+	if start >= size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+
+	end := size - 1
+
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+
+		end = min(end, size-1)
+	}
+
+	return start, end - start + 1, nil
+}
@@ -1,115 +1,359 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
-	"s3-analytics/internal/logging"
+	"s3-analytics/internal/api/middleware"
 	"s3-analytics/internal/services"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 )
 
 type FilesHandler struct {
-	Service *services.DynamoDBService
-	CWService *services.CloudWatchService
-	Logger *logging.StructuredLogger
+	Storage  services.BlobStore
+	Metadata services.MetadataStore
+	// DownloadExpiry is how long presigned download URLs stay valid.
+	DownloadExpiry time.Duration
 }
 
-func NewFilesHandler(service *services.DynamoDBService, cwService *services.CloudWatchService) *FilesHandler {
+func NewFilesHandler(storage services.BlobStore, metadata services.MetadataStore) *FilesHandler {
 	return &FilesHandler{
-		Service: service,
-		CWService: cwService,
-		Logger: logging.NewStructuredLogger(),
+		Storage:  storage,
+		Metadata: metadata,
 	}
 }
 
+// GetAllFiles returns one page of files. See listQuery for the supported
+// query parameters.
 func (h *FilesHandler) GetAllFiles(context *gin.Context) {
-	start := time.Now()
-	traceId := uuid.NewString()
-	log := h.Logger.WithTrace(traceId, "api", "GET", "/files")
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
 
-	data, err := h.Service.GetAllItems(context)
+	query, err := listQuery(context)
+
+	if err != nil {
+		writeProblem(context, http.StatusUnprocessableEntity, "Invalid list request: "+err.Error())
+		return
+	}
+
+	page, err := h.Metadata.ListItems(ctx, query)
+
+	if errors.Is(err, services.ErrInvalidCursor) {
+		writeProblem(context, http.StatusUnprocessableEntity, "Invalid list request: cursor is not valid.")
+		return
+	}
 
 	if err != nil {
-		h.CWService.EmitAsyncFailure(context, "GET /files", log)
 		log.Error("Failed to retrieve file metadata.", "error", err)
-		context.JSON(http.StatusBadRequest, gin.H{"error": "Failed to retrieve file metadata.", "detail": err.Error(),})
+		writeError(context, err, "Failed to retrieve file metadata.")
 		return
 	}
 
-	latency := time.Since(start).Milliseconds()
-	log.Info("All file metadata retrieved successfully",
-    	"latency_ms", latency,
-	)
-	
-	h.CWService.EmitAsyncMetrics(context, "GET /files", int(latency), log)
+	log.Info("All file metadata retrieved successfully", "count", len(page.Items))
 
 	context.JSON(http.StatusOK, gin.H{
-        "data": data,
-        "message": "All file metadata retrieved successfully.",
-    })
-} 
+		"traceId":    middleware.TraceID(context),
+		"data":       page.Items,
+		"nextCursor": page.NextCursor,
+		"message":    "All file metadata retrieved successfully.",
+	})
+}
+
+// listQuery reads the listing parameters: limit, cursor, state,
+// createdAfter and createdBefore (RFC 3339), minSize, maxSize,
+// filenamePrefix, order (asc or desc, the default) and includeDeleted.
+func listQuery(context *gin.Context) (services.ListQuery, error) {
+	query := services.ListQuery{
+		Cursor:         context.Query("cursor"),
+		State:          services.State(context.Query("state")),
+		FilenamePrefix: context.Query("filenamePrefix"),
+		Descending:     true,
+		IncludeDeleted: includeDeleted(context),
+	}
+
+	if v := context.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > services.MaxListLimit {
+			return query, fmt.Errorf("limit must be between 1 and %d", services.MaxListLimit)
+		}
+		query.Limit = limit
+	}
+
+	if query.State != "" && !query.State.Valid() {
+		return query, fmt.Errorf("unknown state %q", query.State)
+	}
+
+	for name, target := range map[string]*time.Time{"createdAfter": &query.CreatedAfter, "createdBefore": &query.CreatedBefore} {
+		if v := context.Query(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return query, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+			}
+			*target = t
+		}
+	}
+
+	for name, target := range map[string]**int64{"minSize": &query.MinSize, "maxSize": &query.MaxSize} {
+		if v := context.Query(name); v != "" {
+			size, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || size < 0 {
+				return query, fmt.Errorf("%s must be a non-negative integer", name)
+			}
+			*target = &size
+		}
+	}
+
+	switch context.DefaultQuery("order", "desc") {
+	case "asc":
+		query.Descending = false
+	case "desc":
+	default:
+		return query, errors.New("order must be asc or desc")
+	}
+
+	return query, nil
+}
+
+// includeDeleted reports whether the caller asked for soft-deleted files
+// with includeDeleted=true; otherwise they are treated as gone.
+func includeDeleted(context *gin.Context) bool {
+	return context.Query("includeDeleted") == "true"
+}
+
+// HeadBySha256 reports whether a processed file has the given content
+// hash, so a client can declare the sha256 on POST /files and skip sending
+// the bytes. It answers 200 when one does and 404 when none does.
+func (h *FilesHandler) HeadBySha256(context *gin.Context) {
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
+
+	hash := strings.ToLower(context.Param("hash"))
+
+	if !validSha256(hash) {
+		writeProblem(context, http.StatusUnprocessableEntity, "sha256 must be 64 hexadecimal characters.")
+		return
+	}
+
+	file, err := services.FindProcessed(ctx, h.Metadata, hash)
+
+	if err != nil {
+		log.Error("Failed to look up sha256.", "error", err)
+		writeError(context, err, "Failed to look up sha256.")
+		return
+	}
+
+	if file == nil {
+		context.Status(http.StatusNotFound)
+		return
+	}
+
+	context.Status(http.StatusOK)
+}
+
+// validSha256 reports whether s is a lower-case hex sha256.
+func validSha256(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
 
 func (h *FilesHandler) GetSingleFile(context *gin.Context) {
-	start := time.Now()
-	traceId := uuid.NewString()
-	log := h.Logger.WithTrace(traceId, "api", "GET", "/files/:id")
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
 
 	fileId := context.Param("id")
 
-	data, err := h.Service.GetFileById(context, fileId)
+	data, err := h.Metadata.GetFileById(ctx, fileId)
 
 	if err != nil {
-		h.CWService.EmitAsyncFailure(context, "GET /files/:id", log)
 		log.Error("Failed to retrieve file metadata.", "error", err)
-		context.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to retrieve file metadata %s.", fileId), "detail": err.Error(),})
+		writeError(context, err, fmt.Sprintf("Failed to retrieve file metadata %s.", fileId))
 		return
 	}
 
-	latency := time.Since(start).Milliseconds()
-	log.Info("File metadata retrieved successfully",
-    	"latency_ms", time.Since(start).Milliseconds(),
-	)	
-	h.CWService.EmitAsyncMetrics(context, "GET /files/:id", int(latency), log)
+	if data.Deleted() && !includeDeleted(context) {
+		writeProblem(context, http.StatusNotFound, fmt.Sprintf("File %s not found.", fileId))
+		return
+	}
+
+	log.Info("File metadata retrieved successfully")
 	context.JSON(http.StatusOK, gin.H{
-        "data": data,
-        "message": fmt.Sprintf("File metadata %s retrieved successfully.", fileId),
-    })
-} 
+		"traceId": middleware.TraceID(context),
+		"data":    data,
+		"message": fmt.Sprintf("File metadata %s retrieved successfully.", fileId),
+	})
+}
 
+// GetFileStatus reports where a file is in the processing state machine:
+// its state, the processing attempts made, the last error and when it
+// entered each state. A deleted file is only reported with includeDeleted.
 func (h *FilesHandler) GetFileStatus(context *gin.Context) {
-	start := time.Now()
-	traceId := uuid.NewString()
-	log := h.Logger.WithTrace(traceId, "api", "GET", "/files/:id/status")
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
 
 	fileId := context.Param("id")
 
-	file, err := h.Service.GetFileById(context, fileId)
+	file, err := h.Metadata.GetFileById(ctx, fileId)
 
 	if err != nil {
-		h.CWService.EmitAsyncFailure(context, "GET /files/:id", log)
 		log.Error("Failed to retrieve file status.", "error", err)
-		context.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to retrieve file status %s.", fileId), "detail": err.Error(),})
-		return
-	}
-
-    if file.ProcessingState != "done" {
-		log.Info("File processing not completed yet.")
-        context.JSON(http.StatusOK, gin.H{
-            "status": file.ProcessingState,
-            "result": "processing not completed yet",
-        })
-        return
-    }
-	latency := time.Since(start).Milliseconds()
-	log.Info("File processing completed.",
-    	"latency_ms", latency,
-	)	
-	h.CWService.EmitAsyncMetrics(context, "GET /files/:id/status", int(latency), log)
-    context.JSON(http.StatusOK, gin.H{
-        "status": file.ProcessingState,
-        "result": "File processing completed.",
-    })
-} 
\ No newline at end of file
+		writeError(context, err, fmt.Sprintf("Failed to retrieve file status %s.", fileId))
+		return
+	}
+
+	if file.Deleted() && !includeDeleted(context) {
+		writeProblem(context, http.StatusNotFound, fmt.Sprintf("File %s not found.", fileId))
+		return
+	}
+
+	log.Info("File status retrieved.", "state", file.ProcessingState)
+
+	response := gin.H{
+		"traceId":        middleware.TraceID(context),
+		"id":             file.ID,
+		"status":         file.ProcessingState,
+		"result":         statusResults[file.ProcessingState],
+		"attempts":       file.Attempts,
+		"createdAt":      file.CreatedAt,
+		"stateChangedAt": file.StateTimes(),
+	}
+
+	if file.LastError != "" {
+		response["lastError"] = file.LastError
+	}
+
+	context.JSON(http.StatusOK, response)
+}
+
+// statusResults describes each state in GetFileStatus responses.
+var statusResults = map[services.State]string{
+	services.StatePendingUpload: "upload not completed yet",
+	services.StateUploaded:      "processing not started yet",
+	services.StateProcessing:    "processing in progress",
+	services.StateDone:          "File processing completed.",
+	services.StateFailed:        "processing failed",
+	services.StateQuarantined:   "content quarantined",
+	services.StateDeleted:       "file deleted",
+}
+
+// DeleteFile soft-deletes a file. It disappears from listings at once and is
+// purged after the grace period unless it is restored first.
+func (h *FilesHandler) DeleteFile(context *gin.Context) {
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
+
+	fileId := context.Param("id")
+
+	file, err := h.Metadata.GetFileById(ctx, fileId)
+
+	if err != nil {
+		log.Error("Failed to retrieve file metadata.", "error", err)
+		writeError(context, err, fmt.Sprintf("File %s could not be deleted.", fileId))
+		return
+	}
+
+	if file.Deleted() {
+		writeProblem(context, http.StatusNotFound, fmt.Sprintf("File %s is already deleted.", fileId))
+		return
+	}
+
+	if file.ProcessingState == services.StateProcessing {
+		writeProblem(context, http.StatusConflict, fmt.Sprintf("File %s is being processed; retry once processing has finished.", fileId))
+		return
+	}
+
+	deletedAt := time.Now().UTC()
+	update := services.Transition(file.ProcessingState, services.StateDeleted)
+	update.DeletedAt = &deletedAt
+	update.RestoreState = &file.ProcessingState
+
+	err = h.Metadata.UpdateItem(ctx, fileId, update)
+
+	if errors.Is(err, services.ErrStateConflict) {
+		writeProblem(context, http.StatusConflict, fmt.Sprintf("File %s was modified concurrently.", fileId))
+		return
+	}
+
+	if err != nil {
+		log.Error("File delete failed.", "error", err)
+		writeError(context, err, fmt.Sprintf("File %s could not be deleted.", fileId))
+		return
+	}
+
+	log.Info("File deleted.", "file_id", fileId)
+
+	context.JSON(http.StatusOK, gin.H{
+		"traceId":   middleware.TraceID(context),
+		"id":        fileId,
+		"deletedAt": deletedAt,
+		"message":   fmt.Sprintf("File %s deleted.", fileId),
+	})
+}
+
+// RestoreFile undoes a soft delete that has not been purged yet.
+func (h *FilesHandler) RestoreFile(context *gin.Context) {
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
+
+	fileId := context.Param("id")
+
+	file, err := h.Metadata.GetFileById(ctx, fileId)
+
+	if err != nil {
+		log.Error("Failed to retrieve file metadata.", "error", err)
+		writeError(context, err, fmt.Sprintf("File %s could not be restored.", fileId))
+		return
+	}
+
+	if !file.Deleted() {
+		writeProblem(context, http.StatusConflict, fmt.Sprintf("File %s is not deleted.", fileId))
+		return
+	}
+
+	update := services.FileUpdate{}
+
+	if file.ProcessingState == services.StateDeleted {
+		restoreState := file.RestoreState
+		// Files deleted mid-run before that was refused have no run left
+		// to finish them; they are processed again instead.
+		if restoreState == services.StateProcessing {
+			restoreState = services.StateUploaded
+		}
+		update = services.Transition(services.StateDeleted, restoreState)
+	} else {
+		// Deleted before deleted was a processing state.
+		deleted := true
+		update.ExpectDeleted = &deleted
+	}
+	update.Restore = true
+
+	err = h.Metadata.UpdateItem(ctx, fileId, update)
+
+	if errors.Is(err, services.ErrStateConflict) {
+		writeProblem(context, http.StatusConflict, fmt.Sprintf("File %s is not deleted.", fileId))
+		return
+	}
+
+	if err != nil {
+		log.Error("File restore failed.", "error", err)
+		writeError(context, err, fmt.Sprintf("File %s could not be restored.", fileId))
+		return
+	}
+
+	log.Info("File restored.", "file_id", fileId)
+
+	context.JSON(http.StatusOK, gin.H{
+		"traceId": middleware.TraceID(context),
+		"id":      fileId,
+		"message": fmt.Sprintf("File %s restored.", fileId),
+	})
+}
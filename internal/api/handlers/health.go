@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"s3-analytics/internal/api/middleware"
+	"s3-analytics/internal/services"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// DefaultReadyCacheTTL is how long readiness results are reused, so
+	// frequent probes do not turn into a stream of AWS calls.
+	DefaultReadyCacheTTL = 10 * time.Second
+
+	readyCheckTimeout = 3 * time.Second
+)
+
+// HealthHandler serves the liveness and readiness probes.
+type HealthHandler struct {
+	// Checks are run by Ready, keyed by the name reported for them.
+	Checks map[string]services.HealthChecker
+	// CacheTTL is how long a readiness result is reused.
+	CacheTTL time.Duration
+
+	draining atomic.Bool
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	failed    []string
+}
+
+// NewHealthHandler checks the storage and metadata backends for readiness
+// when they implement services.HealthChecker.
+func NewHealthHandler(storage services.BlobStore, metadata services.MetadataStore) *HealthHandler {
+	checks := map[string]services.HealthChecker{}
+
+	if checker, ok := storage.(services.HealthChecker); ok {
+		checks["storage"] = checker
+	}
+	if checker, ok := metadata.(services.HealthChecker); ok {
+		checks["metadata"] = checker
+	}
+
+	return &HealthHandler{
+		Checks:   checks,
+		CacheTTL: DefaultReadyCacheTTL,
+	}
+}
+
+// Drain makes Ready fail from now on, so load balancers stop sending new
+// requests while the server shuts down.
+func (h *HealthHandler) Drain() {
+	h.draining.Store(true)
+}
+
+// Live reports that the process is up. It does not touch any backend.
+func (h *HealthHandler) Live(context *gin.Context) {
+	context.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+// Ready reports whether the backends are reachable.
+func (h *HealthHandler) Ready(context *gin.Context) {
+	if h.draining.Load() {
+		writeProblem(context, http.StatusServiceUnavailable, "Server is shutting down.")
+		return
+	}
+
+	if failed := h.check(middleware.Logger(context)); len(failed) > 0 {
+		writeProblem(context, http.StatusServiceUnavailable, "Not ready: "+strings.Join(failed, ", ")+" unavailable.")
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"status": "ready",
+	})
+}
+
+// check returns the names of the failing checks, reusing the previous
+// result while it is younger than CacheTTL. Concurrent probes wait for a
+// single run instead of each calling the backends.
+func (h *HealthHandler) check(log *slog.Logger) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.checkedAt.IsZero() && time.Since(h.checkedAt) < h.CacheTTL {
+		return h.failed
+	}
+
+	// Not the request context: a result is shared with later probes, so one
+	// client going away must not fail it.
+	ctx, cancel := context.WithTimeout(context.Background(), readyCheckTimeout)
+	defer cancel()
+
+	var failed []string
+	for name, checker := range h.Checks {
+		if err := checker.CheckHealth(ctx); err != nil {
+			log.Error("Readiness check failed.", "check", name, "error", err)
+			failed = append(failed, name)
+		}
+	}
+	slices.Sort(failed)
+
+	h.failed = failed
+	h.checkedAt = time.Now()
+
+	return failed
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"s3-analytics/internal/api/middleware"
+	"s3-analytics/internal/services"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// IdempotencyKeyHeader makes POST /files safe to retry: a retry with the
+	// same key gets the original response instead of a second upload.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses replayed for a retry.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	// DefaultIdempotencyTTL is how long a key is remembered.
+	DefaultIdempotencyTTL = 24 * time.Hour
+	// DefaultIdempotencyLease is how long an upload in progress holds its
+	// key between renewals.
+	DefaultIdempotencyLease = 5 * time.Minute
+
+	maxIdempotencyKeyLength = 255
+
+	// idempotencyTimeout bounds recording or releasing a key.
+	idempotencyTimeout = 5 * time.Second
+)
+
+// validIdempotencyKey accepts up to 255 printable ASCII characters.
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// uploadFingerprint identifies an upload's payload. It is taken over the
+// filename and content rather than the raw body, whose multipart boundary
+// changes from one attempt to the next.
+func uploadFingerprint(filename, sha256Hex string) string {
+	sum := sha256.Sum256([]byte(filename + "\x00" + sha256Hex))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *UploadHandler) idempotencyTTL() time.Duration {
+	if h.IdempotencyTTL > 0 {
+		return h.IdempotencyTTL
+	}
+	return DefaultIdempotencyTTL
+}
+
+func (h *UploadHandler) idempotencyLease() time.Duration {
+	if h.IdempotencyLease > 0 {
+		return h.IdempotencyLease
+	}
+	return DefaultIdempotencyLease
+}
+
+// completeIdempotencyKey records the response for a claimed key. Like
+// releaseIdempotencyKey it outlives the request: a client that has given up
+// is exactly the one that will retry.
+func (h *UploadHandler) completeIdempotencyKey(ctx context.Context, record services.IdempotencyRecord) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), idempotencyTimeout)
+	defer cancel()
+
+	return h.Idempotency.Complete(ctx, record)
+}
+
+func (h *UploadHandler) releaseIdempotencyKey(ctx context.Context, key, token string) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), idempotencyTimeout)
+	defer cancel()
+
+	return h.Idempotency.Release(ctx, key, token)
+}
+
+// holdIdempotencyKey renews the claim on key every third of the lease, so an
+// upload that outlasts the lease keeps its key. The returned stop function
+// ends the renewals and waits for one in flight, so none extends the record
+// after it has been completed.
+func (h *UploadHandler) holdIdempotencyKey(ctx context.Context, log *slog.Logger, key, token string) (stop func()) {
+	lease := h.idempotencyLease()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			renewCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), idempotencyTimeout)
+			err := h.Idempotency.Renew(renewCtx, key, token, time.Now().Add(lease))
+			cancel()
+
+			if errors.Is(err, services.ErrConflict) {
+				log.Warn("Idempotency key was claimed by another request.")
+				return
+			}
+
+			if err != nil {
+				log.Error("Failed to renew idempotency key.", "error", err)
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+// replayUpload answers a retry of an upload whose key is already held. Any
+// content is read, but not stored, to check it matches the original.
+func (h *UploadHandler) replayUpload(context *gin.Context, record *services.IdempotencyRecord, form *uploadForm, body *sizeLimitedReader) {
+	log := middleware.Logger(context).With("idempotency_key", record.Key)
+
+	if !record.Completed() {
+		log.Warn("Request with this idempotency key is still in progress.")
+		writeProblem(context, http.StatusConflict, "A request with this Idempotency-Key is still in progress.")
+		return
+	}
+
+	sum := form.Sha256
+
+	if form.Part != nil {
+		var ok bool
+		if sum, ok = h.digest(context, body); !ok {
+			return
+		}
+	}
+
+	if uploadFingerprint(form.Filename, sum) != record.Fingerprint {
+		log.Warn("Idempotency key reused with a different payload.")
+		writeProblem(context, http.StatusConflict, "Idempotency-Key was already used for a different upload.")
+		return
+	}
+
+	log.Info("Replaying idempotent response.")
+
+	context.Header(IdempotentReplayedHeader, "true")
+	context.Data(record.StatusCode, "application/json; charset=utf-8", record.Body)
+}
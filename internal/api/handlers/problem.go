@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"s3-analytics/internal/api/middleware"
+	"s3-analytics/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 error body. Every handler reports failures with one.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// TraceID is an extension member so failures can be matched to logs.
+	TraceID string `json:"traceId,omitempty"`
+}
+
+// writeProblem aborts the request with a problem+json body.
+func writeProblem(context *gin.Context, status int, detail string) {
+	context.Header("Content-Type", problemContentType)
+	context.AbortWithStatusJSON(status, Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: context.Request.URL.Path,
+		TraceID:  middleware.TraceID(context),
+	})
+}
+
+// writeError reports err with the status its kind maps to. Only detail is
+// sent to the client; err may carry backend messages and is never exposed.
+func writeError(context *gin.Context, err error, detail string) {
+	status := statusFor(err)
+
+	if status == http.StatusTooManyRequests {
+		context.Header("Retry-After", "1")
+	}
+
+	writeProblem(context, status, detail)
+}
+
+// statusFor maps a service error kind to an HTTP status.
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, services.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, services.ErrValidation):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, services.ErrThrottled):
+		return http.StatusTooManyRequests
+	case errors.Is(err, services.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,583 @@
+package handlers
+
+import (
+	"bytes"
+	stdctx "context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"s3-analytics/internal/api/middleware"
+	"s3-analytics/internal/services"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	// tusPartSize is the size of every part but the last. It does not grow
+	// with Upload-Length, so a PATCH never holds more than one part in
+	// memory whatever the client declares.
+	tusPartSize = services.DefaultPartSize
+	// tusMaxSize is as much as MaxUploadParts parts of tusPartSize hold.
+	tusMaxSize = tusPartSize * services.MaxUploadParts
+	// tusLeaseDuration bounds how long a PATCH may go between renewals of
+	// its upload lease; each renewal covers one storage write.
+	tusLeaseDuration = 5 * time.Minute
+)
+
+// TusHandler implements the tus 1.0 resumable upload protocol on top of a
+// multipart upload. Bytes that do not yet fill a whole part are parked in a
+// tail object (tus/<id>-<offset>.part) and prepended to the next PATCH. The
+// previous tail is only deleted once the record points past it. The offset and
+// committed parts live on the FileMetadata record, which stays pending_upload
+// until the last byte arrives and the object lands at its raw/ key. A PATCH
+// leases the record before writing, so concurrent PATCHes cannot overwrite
+// each other's tail or parts.
+type TusHandler struct {
+	Storage  services.BlobStore
+	Metadata services.MetadataStore
+	Notifier services.UploadNotifier
+	// MaxUploadSize, when positive, lowers Tus-Max-Size.
+	MaxUploadSize int64
+
+	// buffers recycles part buffers across PATCH requests.
+	buffers sync.Pool
+}
+
+func NewTusHandler(storage services.BlobStore, metadata services.MetadataStore, notifier services.UploadNotifier) *TusHandler {
+	return &TusHandler{
+		Storage:  storage,
+		Metadata: metadata,
+		Notifier: notifier,
+	}
+}
+
+// RequireTusResumable rejects requests for another protocol version and
+// stamps Tus-Resumable on every response. OPTIONS is exempt, per the spec.
+func RequireTusResumable(context *gin.Context) {
+	if context.Request.Method == http.MethodOptions {
+		context.Next()
+		return
+	}
+
+	context.Header("Tus-Resumable", tusVersion)
+
+	if context.GetHeader("Tus-Resumable") != tusVersion {
+		context.Header("Tus-Version", tusVersion)
+		context.AbortWithStatus(http.StatusPreconditionFailed)
+		return
+	}
+
+	context.Next()
+}
+
+func (h *TusHandler) Options(context *gin.Context) {
+	context.Header("Tus-Resumable", tusVersion)
+	context.Header("Tus-Version", tusVersion)
+	context.Header("Tus-Extension", tusExtensions)
+	context.Header("Tus-Max-Size", strconv.FormatInt(h.maxSize(), 10))
+	context.Status(http.StatusNoContent)
+}
+
+// maxSize is the Tus-Max-Size advertised and enforced.
+func (h *TusHandler) maxSize() int64 {
+	if h.MaxUploadSize > 0 {
+		return min(h.MaxUploadSize, tusMaxSize)
+	}
+	return tusMaxSize
+}
+
+// Create handles the creation extension: it opens the multipart upload and
+// the pending_upload record, and returns the upload URL in Location.
+func (h *TusHandler) Create(context *gin.Context) {
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
+
+	multipartStore, ok := h.Storage.(services.MultipartStore)
+
+	if !ok {
+		writeProblem(context, http.StatusNotImplemented, "Resumable uploads are not supported by this storage backend.")
+		return
+	}
+
+	length, err := strconv.ParseInt(context.GetHeader("Upload-Length"), 10, 64)
+
+	if err != nil || length < 0 {
+		writeProblem(context, http.StatusBadRequest, "Invalid Upload-Length header.")
+		return
+	}
+
+	if length > h.maxSize() {
+		writeProblem(context, http.StatusRequestEntityTooLarge, "Upload exceeds Tus-Max-Size.")
+		return
+	}
+
+	filename := path.Base(parseTusMetadata(context.GetHeader("Upload-Metadata"))["filename"])
+
+	if filename == "/" || filename == "." || filename == ".." {
+		filename = "upload"
+	}
+
+	id := uuid.NewString()
+	key := services.RawKey(id, filename)
+	metadata := services.FileMetadata{
+		ID:              id,
+		Filename:        filename,
+		Size:            length,
+		ProcessingState: services.StatePendingUpload,
+		CreatedAt:       time.Now().UTC(),
+		TraceID:         middleware.TraceID(context),
+	}
+
+	objectMetadata := services.ObjectMetadata(ctx, middleware.TraceID(context))
+
+	// An empty upload is finished as soon as it is created.
+	if length == 0 {
+		err = h.Storage.PutObject(ctx, key, bytes.NewReader(nil), objectMetadata)
+		metadata.ProcessingState = services.StateUploaded
+	} else {
+		metadata.UploadID, err = multipartStore.CreateMultipartUpload(ctx, key, objectMetadata)
+	}
+
+	if err != nil {
+		log.Error("Resumable upload creation failed.", "error", err)
+		writeError(context, err, "Upload creation failed.")
+		return
+	}
+
+	if err := h.Metadata.CreateItem(ctx, &metadata); err != nil {
+		log.Error("File metadata record create failed.", "error", err)
+		if metadata.UploadID != "" {
+			abortMultipartUpload(ctx, log, multipartStore, key, metadata.UploadID)
+		} else {
+			deleteOrphanedObject(ctx, log, h.Storage, key)
+		}
+		writeError(context, err, "Metadata record creation failed.")
+		return
+	}
+
+	if length == 0 && h.Notifier != nil {
+		h.Notifier.NotifyUploaded(ctx, key)
+	}
+
+	log.Info("Resumable upload created.", "file_id", id, "upload_length", length)
+
+	context.Header("Location", "/files/tus/"+id)
+	context.Header("Upload-Offset", "0")
+	context.Status(http.StatusCreated)
+}
+
+// Head reports the current offset so a client can resume. An upload whose
+// bytes have all arrived but that failed to finish is finished first, since
+// the client will not send another PATCH.
+func (h *TusHandler) Head(context *gin.Context) {
+	log := middleware.Logger(context)
+
+	file, ok := h.lookup(context)
+
+	if !ok {
+		return
+	}
+
+	if h.unfinished(file) {
+		if err := h.finish(stdctx.WithoutCancel(context.Request.Context()), file, file.UploadParts); err != nil {
+			log.Error("Resumable upload completion failed.", "error", err)
+			writeError(context, err, "Upload completion failed.")
+			return
+		}
+	}
+
+	offset := file.UploadOffset
+	if file.ProcessingState != services.StatePendingUpload {
+		offset = file.Size
+	}
+
+	context.Header("Cache-Control", "no-store")
+	context.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	context.Header("Upload-Length", strconv.FormatInt(file.Size, 10))
+	context.Status(http.StatusOK)
+}
+
+// Patch appends the request body at Upload-Offset. Whatever arrives before
+// the client disconnects is kept, so the next HEAD resumes after it.
+func (h *TusHandler) Patch(context *gin.Context) {
+	log := middleware.Logger(context)
+
+	if context.ContentType() != "application/offset+octet-stream" {
+		context.Status(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	file, ok := h.lookup(context)
+
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(context.GetHeader("Upload-Offset"), 10, 64)
+
+	if err != nil {
+		writeProblem(context, http.StatusBadRequest, "Invalid Upload-Offset header.")
+		return
+	}
+
+	if file.ProcessingState != services.StatePendingUpload || file.UploadID == "" || offset != file.UploadOffset {
+		writeProblem(context, http.StatusConflict, fmt.Sprintf("Upload-Offset does not match the current offset %d.", file.UploadOffset))
+		return
+	}
+
+	if length := context.Request.ContentLength; length > 0 && offset+length > file.Size {
+		writeProblem(context, http.StatusBadRequest, "Request body exceeds Upload-Length.")
+		return
+	}
+
+	// Keep going after a client disconnect so the bytes received so far are
+	// committed and the upload can resume from them.
+	storeCtx := stdctx.WithoutCancel(context.Request.Context())
+
+	if h.unfinished(file) {
+		if err := h.finish(storeCtx, file, file.UploadParts); err != nil {
+			log.Error("Resumable upload completion failed.", "error", err)
+			writeError(context, err, "Upload completion failed.")
+			return
+		}
+
+		context.Header("Upload-Offset", strconv.FormatInt(file.Size, 10))
+		context.Status(http.StatusNoContent)
+		return
+	}
+
+	lease := uuid.NewString()
+	now := time.Now().UTC()
+	until := now.Add(tusLeaseDuration)
+
+	err = h.Metadata.UpdateItem(storeCtx, file.ID, services.FileUpdate{
+		UploadLease:      &lease,
+		UploadLeaseUntil: &until,
+		ExpectState:      &file.ProcessingState,
+		ExpectOffset:     &file.UploadOffset,
+		ExpectLeaseFree:  &now,
+	})
+
+	if errors.Is(err, services.ErrStateConflict) {
+		writeProblem(context, http.StatusLocked, "Upload is being appended to by another request.")
+		return
+	}
+
+	if err != nil {
+		log.Error("File metadata update failed.", "error", err)
+		writeError(context, err, "Metadata update failed.")
+		return
+	}
+
+	body := io.LimitReader(context.Request.Body, file.Size-offset)
+
+	newOffset, parts, err := h.appendChunk(storeCtx, file, lease, body)
+
+	if err != nil && !errors.Is(err, services.ErrStateConflict) {
+		// Let a retry in right away rather than after the lease expires.
+		h.Metadata.UpdateItem(storeCtx, file.ID, services.FileUpdate{UploadLease: awssdk.String(""), ExpectLease: &lease})
+	}
+
+	if err == nil {
+		err = h.Metadata.UpdateItem(storeCtx, file.ID, services.FileUpdate{
+			UploadOffset: &newOffset,
+			UploadParts:  parts,
+			UploadLease:  awssdk.String(""),
+			ExpectState:  &file.ProcessingState,
+			ExpectOffset: &file.UploadOffset,
+			ExpectLease:  &lease,
+		})
+	}
+
+	if err == nil && newOffset != file.UploadOffset {
+		// A leftover tail is harmless; finish and termination sweep them.
+		if err := h.Storage.DeleteObject(storeCtx, services.ResumableTailKey(file.ID, file.UploadOffset)); err != nil {
+			log.Warn("Failed to delete the previous tail.", "file_id", file.ID, "error", err)
+		}
+	}
+
+	if errors.Is(err, services.ErrStateConflict) {
+		writeProblem(context, http.StatusConflict, "Upload was modified concurrently.")
+		return
+	}
+
+	if err != nil {
+		log.Error("Resumable upload append failed.", "error", err)
+		writeError(context, err, "Upload append failed.")
+		return
+	}
+
+	if newOffset == file.Size {
+		if err := h.finish(storeCtx, file, parts); err != nil {
+			log.Error("Resumable upload completion failed.", "error", err)
+			writeError(context, err, "Upload completion failed.")
+			return
+		}
+	}
+
+	log.Info("Resumable upload chunk stored.", "file_id", file.ID, "offset", newOffset)
+
+	context.Header("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	context.Status(http.StatusNoContent)
+}
+
+// Delete handles the termination extension. It takes the upload lease like a
+// PATCH does, so an upload is not torn down under a PATCH still writing to it.
+func (h *TusHandler) Delete(context *gin.Context) {
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
+
+	file, ok := h.lookup(context)
+
+	if !ok {
+		return
+	}
+
+	if file.ProcessingState != services.StatePendingUpload {
+		writeProblem(context, http.StatusConflict, "Upload is already finished.")
+		return
+	}
+
+	lease := uuid.NewString()
+	now := time.Now().UTC()
+	until := now.Add(tusLeaseDuration)
+
+	err := h.Metadata.UpdateItem(ctx, file.ID, services.FileUpdate{
+		UploadLease:      &lease,
+		UploadLeaseUntil: &until,
+		ExpectState:      &file.ProcessingState,
+		ExpectLeaseFree:  &now,
+	})
+
+	if errors.Is(err, services.ErrStateConflict) {
+		writeProblem(context, http.StatusLocked, "Upload is being appended to by another request.")
+		return
+	}
+
+	if err != nil {
+		log.Error("File metadata update failed.", "error", err)
+		writeError(context, err, "Metadata update failed.")
+		return
+	}
+
+	key := services.RawKey(file.ID, file.Filename)
+	multipartStore := h.Storage.(services.MultipartStore)
+
+	err = errors.Join(
+		multipartStore.AbortMultipartUpload(ctx, key, file.UploadID),
+		services.DeleteResumableTails(ctx, h.Storage, file.ID, file.UploadOffset),
+		h.Metadata.DeleteItem(ctx, file.ID),
+	)
+
+	if err != nil {
+		log.Error("Resumable upload termination failed.", "error", err)
+		// Let a retried DELETE in right away rather than after the lease expires.
+		h.Metadata.UpdateItem(ctx, file.ID, services.FileUpdate{UploadLease: awssdk.String(""), ExpectLease: &lease})
+		writeError(context, err, "Upload termination failed.")
+		return
+	}
+
+	log.Info("Resumable upload terminated.", "file_id", file.ID)
+
+	context.Status(http.StatusNoContent)
+}
+
+// lookup loads the upload named by :id, writing a 404 if there is none.
+func (h *TusHandler) lookup(context *gin.Context) (services.FileMetadata, bool) {
+	file, err := h.Metadata.GetFileById(context.Request.Context(), context.Param("id"))
+
+	if err != nil {
+		writeError(context, err, "Failed to retrieve upload.")
+		return file, false
+	}
+
+	if _, ok := h.Storage.(services.MultipartStore); !ok {
+		writeProblem(context, http.StatusNotImplemented, "Resumable uploads are not supported by this storage backend.")
+		return file, false
+	}
+
+	return file, true
+}
+
+// unfinished reports whether every byte of an upload has been committed but
+// finish has yet to succeed.
+func (h *TusHandler) unfinished(file services.FileMetadata) bool {
+	return file.ProcessingState == services.StatePendingUpload && file.UploadID != "" && file.UploadOffset == file.Size
+}
+
+// renewLease extends the upload lease before a storage write. It fails with
+// ErrStateConflict once another request has taken the lease over.
+func (h *TusHandler) renewLease(ctx stdctx.Context, id, lease string) error {
+	until := time.Now().Add(tusLeaseDuration).UTC()
+	return h.Metadata.UpdateItem(ctx, id, services.FileUpdate{UploadLeaseUntil: &until, ExpectLease: &lease})
+}
+
+// appendChunk commits the parked tail plus body as whole parts and parks
+// whatever is left over, renewing lease before each write. It returns the
+// new offset and committed parts.
+func (h *TusHandler) appendChunk(ctx stdctx.Context, file services.FileMetadata, lease string, body io.Reader) (int64, []services.CompletedPart, error) {
+	multipartStore := h.Storage.(services.MultipartStore)
+	key := services.RawKey(file.ID, file.Filename)
+	partSize := int64(tusPartSize)
+	parts := slices.Clone(file.UploadParts)
+	committed := int64(len(parts)) * partSize
+	src := body
+
+	if tail := file.UploadOffset - committed; tail > 0 {
+		data, err := h.readTail(ctx, file.ID, file.UploadOffset, tail)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		src = io.MultiReader(bytes.NewReader(data), body)
+	}
+
+	buf := h.partBuffer()
+	defer h.buffers.Put(&buf)
+
+	for committed < file.Size {
+		// A read error means the client went away; keep what arrived.
+		n, _ := io.ReadFull(src, buf)
+		last := committed+int64(n) == file.Size
+
+		if int64(n) < partSize && !last {
+			offset := committed + int64(n)
+			// The tail is written under the new offset, leaving the one
+			// the record refers to intact until the record moves on.
+			if n > 0 && offset != file.UploadOffset {
+				if err := h.renewLease(ctx, file.ID, lease); err != nil {
+					return 0, nil, err
+				}
+				if err := h.Storage.PutObject(ctx, services.ResumableTailKey(file.ID, offset), bytes.NewReader(buf[:n]), nil); err != nil {
+					return 0, nil, err
+				}
+			}
+			return offset, parts, nil
+		}
+
+		if err := h.renewLease(ctx, file.ID, lease); err != nil {
+			return 0, nil, err
+		}
+
+		number := int32(len(parts) + 1)
+		etag, err := multipartStore.UploadPart(ctx, key, file.UploadID, number, bytes.NewReader(buf[:n]))
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		parts = append(parts, services.CompletedPart{PartNumber: number, ETag: etag})
+		committed += int64(n)
+	}
+
+	return committed, parts, nil
+}
+
+// partBuffer returns a tusPartSize buffer, reusing one from an earlier PATCH
+// when there is one.
+func (h *TusHandler) partBuffer() []byte {
+	if buf, ok := h.buffers.Get().(*[]byte); ok {
+		return *buf
+	}
+	return make([]byte, tusPartSize)
+}
+
+// readTail reads the size bytes parked for the upload at offset.
+func (h *TusHandler) readTail(ctx stdctx.Context, id string, offset, size int64) ([]byte, error) {
+	body, _, err := h.Storage.GetObject(ctx, services.ResumableTailKey(id, offset))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read parked bytes: %w", err)
+	}
+
+	if int64(len(data)) < size {
+		return nil, fmt.Errorf("parked bytes for %s are incomplete: have %d, want %d", id, len(data), size)
+	}
+
+	return data[:size], nil
+}
+
+// finish completes the multipart upload so the object appears at its raw/
+// key, then hands the record to the processor like any other upload. It can
+// be run again after failing part way.
+func (h *TusHandler) finish(ctx stdctx.Context, file services.FileMetadata, parts []services.CompletedPart) error {
+	multipartStore := h.Storage.(services.MultipartStore)
+	key := services.RawKey(file.ID, file.Filename)
+
+	err := multipartStore.CompleteMultipartUpload(ctx, key, file.UploadID, parts)
+
+	// A previous attempt may have completed the upload already.
+	if errors.Is(err, services.ErrNotFound) {
+		_, err = h.Storage.HeadObject(ctx, key)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := services.DeleteResumableTails(ctx, h.Storage, file.ID, file.UploadOffset); err != nil {
+		return err
+	}
+
+	update := services.Transition(services.StatePendingUpload, services.StateUploaded)
+	update.UploadID = awssdk.String("")
+	update.UploadParts = []services.CompletedPart{}
+
+	err = h.Metadata.UpdateItem(ctx, file.ID, update)
+
+	// The processor may already have picked the object up.
+	if err != nil && !errors.Is(err, services.ErrStateConflict) {
+		return err
+	}
+
+	if h.Notifier != nil {
+		h.Notifier.NotifyUploaded(ctx, key)
+	}
+
+	return nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated
+// "key base64(value)" pairs, where the value may be omitted.
+func parseTusMetadata(header string) map[string]string {
+	values := map[string]string{}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+
+		if key == "" {
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(encoded)
+
+		if err != nil {
+			continue
+		}
+
+		values[key] = string(value)
+	}
+
+	return values
+}
@@ -1,9 +1,17 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
 	"net/http"
-	"s3-analytics/internal/logging"
+	"s3-analytics/internal/api/middleware"
 	"s3-analytics/internal/services"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -11,68 +19,431 @@ import (
 )
 
 type UploadHandler struct {
-	S3Service *services.S3Service
-	DynamoDBService *services.DynamoDBService
-	CWService *services.CloudWatchService
-	Logger *logging.StructuredLogger
+	Storage  services.BlobStore
+	Metadata services.MetadataStore
+	// Notifier, when set, is told about each new raw/ object.
+	Notifier services.UploadNotifier
+	// PresignExpiry is how long presigned direct-upload URLs stay valid.
+	PresignExpiry time.Duration
+	// MaxUploadSize, when positive, is the largest upload accepted in bytes.
+	MaxUploadSize int64
+	// Idempotency, when set, remembers uploads made with an Idempotency-Key
+	// for IdempotencyTTL so retries are not stored twice. While an upload
+	// is in progress its key is held for IdempotencyLease at a time.
+	Idempotency      services.IdempotencyStore
+	IdempotencyTTL   time.Duration
+	IdempotencyLease time.Duration
 }
 
-func NewUploadHandler(s3Service *services.S3Service, dynamoDBService *services.DynamoDBService, cwService *services.CloudWatchService) *UploadHandler {
+func NewUploadHandler(storage services.BlobStore, metadata services.MetadataStore, notifier services.UploadNotifier) *UploadHandler {
 	return &UploadHandler{
-		S3Service: s3Service,
-		DynamoDBService: dynamoDBService,
-		CWService: cwService,
-		Logger: logging.NewStructuredLogger(),
+		Storage:  storage,
+		Metadata: metadata,
+		Notifier: notifier,
 	}
 }
 
+// UploadFile stores a multipart upload. A sha256 field sent before the file
+// declares the content's hash: when a processed file already has it, the
+// new file shares that file's content and processed output and the bytes,
+// which may then be left out, are not stored again. Bytes that are sent are
+// checked against the declared hash.
 func (h *UploadHandler) UploadFile(context *gin.Context) {
-	start := time.Now()
-	traceId := uuid.NewString()
-	log := h.Logger.WithTrace(traceId, "api", "POST", "/files")
-	file, err := context.FormFile("file")
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
+	form, err := readUploadForm(context.Request)
 
 	if err != nil {
-		h.CWService.EmitAsyncFailure(context, "POST /files", log)
 		log.Error("Missing file parameter.", "error", err)
-		context.JSON(http.StatusBadRequest,gin.H{"error": "Missing file parameter.", "detail": err.Error(),})
+		writeProblem(context, http.StatusUnprocessableEntity, "Missing file parameter: "+err.Error())
 		return
 	}
 
-	key, id, err := h.S3Service.UploadFileToS3(context, file, traceId)
+	if form.Part != nil {
+		defer form.Part.Close()
+	}
+
+	if form.Sha256 != "" && !validSha256(form.Sha256) {
+		writeProblem(context, http.StatusUnprocessableEntity, "sha256 must be 64 hexadecimal characters.")
+		return
+	}
+
+	body := &sizeLimitedReader{r: form.content(), limit: h.MaxUploadSize}
+
+	idempotencyKey := ""
+	if h.Idempotency != nil {
+		idempotencyKey = context.GetHeader(IdempotencyKeyHeader)
+	}
+
+	completed := false
+	idempotencyToken := uuid.NewString()
+	stopHolding := func() {}
+
+	if idempotencyKey != "" {
+		if !validIdempotencyKey(idempotencyKey) {
+			writeProblem(context, http.StatusUnprocessableEntity, fmt.Sprintf("Idempotency-Key must be at most %d printable ASCII characters.", maxIdempotencyKeyLength))
+			return
+		}
+
+		existing, err := h.Idempotency.Claim(ctx, idempotencyKey, idempotencyToken, time.Now().Add(h.idempotencyLease()))
+
+		if errors.Is(err, services.ErrConflict) {
+			h.replayUpload(context, existing, form, body)
+			return
+		}
+
+		if err != nil {
+			log.Error("Failed to claim idempotency key.", "error", err)
+			writeError(context, err, "Upload failed.")
+			return
+		}
+
+		stopHolding = h.holdIdempotencyKey(ctx, log.With("idempotency_key", idempotencyKey), idempotencyKey, idempotencyToken)
+
+		// Until the response is recorded, any failure frees the key so the
+		// client's retry is processed afresh.
+		defer func() {
+			stopHolding()
+
+			if completed {
+				return
+			}
+
+			if err := h.releaseIdempotencyKey(ctx, idempotencyKey, idempotencyToken); err != nil {
+				log.Error("Failed to release idempotency key.", "error", err)
+			}
+		}()
+	}
+
+	var source *services.FileMetadata
+
+	if form.Sha256 != "" {
+		source, err = services.FindProcessed(ctx, h.Metadata, form.Sha256)
+
+		if err != nil {
+			log.Error("Deduplication lookup failed.", "error", err)
+			writeError(context, err, "Upload failed.")
+			return
+		}
+	}
+
+	var metadata *services.FileMetadata
+
+	switch {
+	case source != nil:
+		metadata = h.deduplicate(context, form, body, source)
+	case form.Part != nil:
+		metadata = h.store(context, form, body)
+	default:
+		writeProblem(context, http.StatusUnprocessableEntity, fmt.Sprintf("No processed file has sha256 %s; send the file content.", form.Sha256))
+		return
+	}
+
+	if metadata == nil {
+		return
+	}
+
+	// A deduplicated file is already processed.
+	if h.Notifier != nil && metadata.ContentKey == "" {
+		h.Notifier.NotifyUploaded(ctx, metadata.RawObjectKey())
+	}
+
+	log.Info("Upload successful.", "file_id", metadata.ID, "deduplicated", source != nil)
+
+	response := gin.H{
+		"traceId":      middleware.TraceID(context),
+		"id":           metadata.ID,
+		"key":          metadata.RawObjectKey(),
+		"deduplicated": source != nil,
+		"message":      "Upload successful.",
+	}
+
+	if idempotencyKey != "" {
+		data, _ := json.Marshal(response)
+
+		stopHolding()
+
+		err := h.completeIdempotencyKey(ctx, services.IdempotencyRecord{
+			Key:         idempotencyKey,
+			Token:       idempotencyToken,
+			Fingerprint: uploadFingerprint(metadata.Filename, metadata.Sha256),
+			StatusCode:  http.StatusOK,
+			Body:        data,
+			ExpiresAt:   time.Now().Add(h.idempotencyTTL()),
+		})
+
+		// The upload itself succeeded, so it is still reported as such; a
+		// retry will just not be recognised.
+		if err != nil {
+			log.Error("Failed to record idempotent response.", "error", err)
+		} else {
+			completed = true
+		}
+	}
+
+	context.JSON(http.StatusOK, response)
+}
+
+// store streams the file part into storage and returns the record for it.
+// The record is written first, as pending_upload, so the object never exists
+// without one; if any later step fails, both are removed again. It writes the
+// error response and returns nil on failure.
+func (h *UploadHandler) store(context *gin.Context, form *uploadForm, body *sizeLimitedReader) *services.FileMetadata {
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
+
+	metadata := &services.FileMetadata{
+		ID:              uuid.NewString(),
+		Filename:        form.Filename,
+		ProcessingState: services.StatePendingUpload,
+		CreatedAt:       time.Now().UTC(),
+		TraceID:         middleware.TraceID(context),
+	}
+
+	if err := h.Metadata.CreateItem(ctx, metadata); err != nil {
+		log.Error("File metadata record create failed.", "error", err)
+		writeError(context, err, "Metadata record creation failed.")
+		return nil
+	}
+
+	key := services.RawKey(metadata.ID, metadata.Filename)
+
+	// Stream the part straight into storage; the body is never buffered whole.
+	upload, err := services.UploadStream(ctx, h.Storage, metadata.ID, form.Filename, body, metadata.TraceID)
+
+	if body.exceeded {
+		log.Warn("Upload exceeds the maximum size.", "max_size", h.MaxUploadSize)
+		h.discardUpload(ctx, log, metadata.ID, key)
+		writeProblem(context, http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload exceeds the maximum size of %d bytes.", h.MaxUploadSize))
+		return nil
+	}
 
 	if err != nil {
-		h.CWService.EmitAsyncFailure(context, "POST /files", log)
 		log.Error("Upload to S3 failed.", "error", err)
-		context.JSON(http.StatusBadRequest, gin.H{"error": "Upload failed.", "detail": err.Error(),})
+		// The object may have been written before the failure was reported.
+		h.discardUpload(ctx, log, metadata.ID, key)
+		writeError(context, err, "Upload failed.")
+		return nil
+	}
+
+	if form.Sha256 != "" && upload.Sha256 != form.Sha256 {
+		log.Warn("Uploaded content does not match the declared sha256.", "declared", form.Sha256, "sha256", upload.Sha256)
+		h.discardUpload(ctx, log, metadata.ID, key)
+		writeProblem(context, http.StatusUnprocessableEntity, "The uploaded content does not match the declared sha256.")
+		return nil
+	}
+
+	update := services.Transition(services.StatePendingUpload, services.StateUploaded)
+	update.Size = &upload.Size
+	update.Sha256 = &upload.Sha256
+
+	err = h.Metadata.UpdateItem(ctx, metadata.ID, update)
+
+	// The processor may have finished first; leave its state in place.
+	if err != nil && !errors.Is(err, services.ErrStateConflict) {
+		log.Error("File metadata update failed.", "error", err)
+		h.discardUpload(ctx, log, metadata.ID, key)
+		writeError(context, err, "Metadata update failed.")
+		return nil
+	}
+
+	metadata.ProcessingState = services.StateUploaded
+	metadata.Size = upload.Size
+	metadata.Sha256 = upload.Sha256
+
+	return metadata
+}
+
+// discardUpload removes the object and the record of an upload that failed
+// part way. It runs detached from the request, which may be what failed.
+// Whatever it cannot remove is logged and left to reconciliation.
+func (h *UploadHandler) discardUpload(ctx context.Context, log *slog.Logger, id, key string) {
+	log = log.With("file_id", id)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	// The object goes first: a record left behind is still visible as
+	// pending_upload, an object left behind is not.
+	if err := h.Storage.DeleteObject(ctx, key); err != nil {
+		log.Error("Failed to delete the object of a failed upload.", "key", key, "error", err)
 		return
 	}
-	// Create file metadata and put item into DynamoDB
-	metadata := services.FileMetadata{
-		ID:        		 id,
-		Filename:  		 file.Filename,
-		Size:      		 file.Size,
-		ProcessingState: "uploaded",
-		CreatedAt: 		 time.Now().UTC(),
+
+	if err := h.Metadata.DeleteItem(ctx, id); err != nil {
+		log.Error("Failed to delete the record of a failed upload.", "error", err)
+		return
 	}
 
-	_, err = h.DynamoDBService.CreateItem(context, &metadata)
-	if err != nil {
-		h.CWService.EmitAsyncFailure(context, "POST /files", log)
+	log.Info("Discarded failed upload.", "key", key)
+}
+
+// deduplicate creates a record sharing source's content and processed
+// output. Any bytes sent are only hashed, to check the declared sha256. It
+// writes the error response and returns nil on failure.
+func (h *UploadHandler) deduplicate(context *gin.Context, form *uploadForm, body *sizeLimitedReader, source *services.FileMetadata) *services.FileMetadata {
+	ctx := context.Request.Context()
+	log := middleware.Logger(context)
+
+	if form.Part != nil {
+		sum, ok := h.digest(context, body)
+
+		if !ok {
+			return nil
+		}
+
+		if sum != form.Sha256 {
+			log.Warn("Uploaded content does not match the declared sha256.", "declared", form.Sha256, "sha256", sum)
+			writeProblem(context, http.StatusUnprocessableEntity, "The uploaded content does not match the declared sha256.")
+			return nil
+		}
+	}
+
+	metadata := &services.FileMetadata{
+		ID:              uuid.NewString(),
+		Filename:        form.Filename,
+		Size:            source.Size,
+		ProcessingState: services.StateDone,
+		CreatedAt:       time.Now().UTC(),
+		TraceID:         middleware.TraceID(context),
+		Sha256:          source.Sha256,
+		ProcessedKey:    source.ProcessedKey,
+		ContentKey:      source.RawObjectKey(),
+	}
+
+	if err := h.Metadata.CreateItem(ctx, metadata); err != nil {
 		log.Error("File metadata record create failed.", "error", err)
-		context.JSON(http.StatusBadRequest, gin.H{"error": "Metadata record creation failed.", "detail": err.Error(),})
-		return
+		writeError(context, err, "Metadata record creation failed.")
+		return nil
+	}
+
+	log.Info("Upload deduplicated.", "source_file_id", source.ID, "processed_key", source.ProcessedKey)
+
+	return metadata
+}
+
+// digest reads body to its end without storing it and returns its hex
+// sha256. It writes the error response and reports false on failure.
+func (h *UploadHandler) digest(context *gin.Context, body *sizeLimitedReader) (string, bool) {
+	digest := services.NewDigestReader(body)
+
+	if _, err := io.Copy(io.Discard, digest); err != nil {
+		if body.exceeded {
+			writeProblem(context, http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload exceeds the maximum size of %d bytes.", h.MaxUploadSize))
+			return "", false
+		}
+
+		middleware.Logger(context).Error("Failed to read upload.", "error", err)
+		writeProblem(context, http.StatusBadRequest, "Failed to read the upload.")
+		return "", false
 	}
 
-	latency := time.Since(start).Milliseconds()
-	log.Info("Upload successful.",
-    	"latency_ms", latency,
-	)
-	h.CWService.EmitAsyncMetrics(context, "POST /files", int(latency), log)
+	return digest.Sha256(), true
+}
+
+// cleanupTimeout bounds removing what a failed upload left behind.
+const cleanupTimeout = 10 * time.Second
 
-    context.JSON(http.StatusOK, gin.H{
-        "key": key,
-        "message": "Upload successful.",
-    })
+// errUploadTooLarge aborts an upload that goes past MaxUploadSize.
+var errUploadTooLarge = errors.New("upload exceeds the maximum size")
 
-}
\ No newline at end of file
+// sizeLimitedReader fails with errUploadTooLarge once more than limit bytes
+// have been read. A zero limit reads without one.
+type sizeLimitedReader struct {
+	r        io.Reader
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.limit <= 0 {
+		return l.r.Read(p)
+	}
+
+	if l.exceeded {
+		return 0, errUploadTooLarge
+	}
+
+	// Read one byte past the limit to tell an exact fit from an overflow.
+	n, err := l.r.Read(p[:min(int64(len(p)), l.limit-l.read+1)])
+	l.read += int64(n)
+
+	if l.read > l.limit {
+		l.exceeded = true
+		return 0, errUploadTooLarge
+	}
+	return n, err
+}
+
+// uploadForm is a POST /files body read up to its file part.
+type uploadForm struct {
+	// Filename is the file part's name, or the filename field when the
+	// request only declares a sha256.
+	Filename string
+	// Sha256 is the optional declared hash of the content, in lower case.
+	Sha256 string
+	// Part is the file content; nil when the request carries none.
+	Part *multipart.Part
+}
+
+// content returns the file content, empty when there is none.
+func (f *uploadForm) content() io.Reader {
+	if f.Part == nil {
+		return strings.NewReader("")
+	}
+	return f.Part
+}
+
+// maxFormFieldSize bounds the fields read before the file part.
+const maxFormFieldSize = 1024
+
+// readUploadForm reads a multipart/form-data request up to its "file" part,
+// without reading any of the file's content. Only fields before the file
+// part are seen. Without a file part, sha256 and filename fields are
+// required instead.
+func readUploadForm(r *http.Request) (*uploadForm, error) {
+	reader, err := r.MultipartReader()
+
+	if err != nil {
+		return nil, err
+	}
+
+	form := &uploadForm{}
+
+	for {
+		part, err := reader.NextPart()
+
+		if err == io.EOF {
+			if form.Sha256 == "" || form.Filename == "" {
+				return nil, errors.New("no file part in request")
+			}
+			return form, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() == "file" && part.FileName() != "" {
+			form.Filename = part.FileName()
+			form.Part = part
+			return form, nil
+		}
+
+		if name := part.FormName(); name == "sha256" || name == "filename" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			if err != nil {
+				return nil, err
+			}
+
+			if name == "sha256" {
+				form.Sha256 = strings.ToLower(strings.TrimSpace(string(value)))
+			} else {
+				form.Filename = strings.TrimSpace(string(value))
+			}
+		}
+
+		part.Close()
+	}
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"s3-analytics/internal/services"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics logs every request once it has been handled and records its
+// latency and status code, plus a failure for any 4xx or 5xx response.
+// Recorders that implement services.PipelineMetrics also get the request
+// body bytes read. It must run after Trace.
+func Metrics(metrics services.MetricsRecorder) gin.HandlerFunc {
+	pipeline, _ := metrics.(services.PipelineMetrics)
+
+	return func(context *gin.Context) {
+		start := time.Now()
+
+		body := &countingReader{ReadCloser: context.Request.Body}
+		context.Request.Body = body
+
+		context.Next()
+
+		endpoint := context.Request.Method + " " + route(context)
+		status := context.Writer.Status()
+		latency := int(time.Since(start).Milliseconds())
+		log := Logger(context)
+
+		log.Info("Request completed.", "status", status, "latency_ms", latency)
+
+		metrics.EmitAsyncMetrics(context.Request.Context(), endpoint, status, latency, log)
+
+		if status >= http.StatusBadRequest {
+			metrics.EmitAsyncFailure(context.Request.Context(), endpoint, log)
+		}
+
+		if pipeline != nil && body.n > 0 {
+			pipeline.RecordUploadBytes(route(context), body.n)
+		}
+	}
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
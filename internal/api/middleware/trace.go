@@ -0,0 +1,119 @@
+// Package middleware holds the gin middleware shared by every route: trace
+// IDs, the request-scoped logger and request metrics.
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+	"s3-analytics/internal/logging"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// TraceHeader carries the trace ID in and out of the API.
+	TraceHeader = "X-Trace-Id"
+	// RequestIDHeader is the conventional request ID header. A caller's
+	// request ID is echoed back unchanged, even when traceparent supplies
+	// the trace ID; otherwise the trace ID is sent.
+	RequestIDHeader = "X-Request-ID"
+	// TraceparentHeader is the W3C Trace Context header. Its trace-id wins
+	// over the other headers.
+	TraceparentHeader = "traceparent"
+)
+
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}`)
+
+const (
+	traceIDKey = "trace_id"
+	loggerKey  = "logger"
+)
+
+// Trace takes the trace ID from the inbound headers, or assigns a new one,
+// echoes it on the response and stores it with a request-scoped logger in
+// the context.
+func Trace(logger *logging.StructuredLogger) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		traceID := inboundTraceID(context.Request.Header)
+
+		// Without a caller-supplied ID, reuse the request span's trace ID so
+		// logs and traces share one ID.
+		if span := trace.SpanContextFromContext(context.Request.Context()); traceID == "" && span.HasTraceID() {
+			traceID = span.TraceID().String()
+		}
+
+		if traceID == "" {
+			traceID = uuid.NewString()
+		}
+
+		context.Set(traceIDKey, traceID)
+		context.Set(loggerKey, logger.WithTrace(traceID, "api", context.Request.Method, route(context)))
+		context.Header(TraceHeader, traceID)
+
+		requestID := strings.TrimSpace(context.GetHeader(RequestIDHeader))
+		if !validTraceID(requestID) {
+			requestID = traceID
+		}
+		context.Header(RequestIDHeader, requestID)
+
+		context.Next()
+	}
+}
+
+// inboundTraceID picks the caller's trace ID: the traceparent trace-id,
+// then X-Request-ID, then X-Trace-Id. IDs that are too long or not printable
+// are ignored so they cannot pollute logs or object metadata.
+func inboundTraceID(header http.Header) string {
+	if match := traceparentPattern.FindStringSubmatch(header.Get(TraceparentHeader)); match != nil && match[1] != strings.Repeat("0", 32) {
+		return match[1]
+	}
+
+	for _, name := range []string{RequestIDHeader, TraceHeader} {
+		if id := strings.TrimSpace(header.Get(name)); validTraceID(id) {
+			return id
+		}
+	}
+
+	return ""
+}
+
+func validTraceID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// TraceID returns the request's trace ID.
+func TraceID(context *gin.Context) string {
+	return context.GetString(traceIDKey)
+}
+
+// Logger returns the request-scoped logger, already tagged with the trace ID,
+// method and route.
+func Logger(context *gin.Context) *slog.Logger {
+	if log, ok := context.Value(loggerKey).(*slog.Logger); ok {
+		return log
+	}
+	return slog.Default()
+}
+
+// route returns the route template, such as /files/:id, so metrics and logs
+// group by route rather than by concrete path.
+func route(context *gin.Context) string {
+	if path := context.FullPath(); path != "" {
+		return path
+	}
+	return "unmatched"
+}
@@ -1,21 +1,31 @@
 package api
 
 import (
-	"net/http"
 	"s3-analytics/internal/api/handlers"
 
 	"github.com/gin-gonic/gin"
 )
 
-func RegisterRoutes(server *gin.Engine, uploadHandler *handlers.UploadHandler, filesHandler *handlers.FilesHandler) {
+func RegisterRoutes(server *gin.Engine, uploadHandler *handlers.UploadHandler, filesHandler *handlers.FilesHandler, tusHandler *handlers.TusHandler, healthHandler *handlers.HealthHandler) {
+	server.GET("/healthz", healthHandler.Live)
+	server.GET("/readyz", healthHandler.Ready)
+
 	server.POST("/files", uploadHandler.UploadFile)
+	server.POST("/files/uploads", uploadHandler.CreateUpload)
+	server.POST("/files/uploads/:id/complete", uploadHandler.CompleteUpload)
 	server.GET("/files", filesHandler.GetAllFiles)
+	server.HEAD("/files/by-sha256/:hash", filesHandler.HeadBySha256)
 	server.GET("/files/:id", filesHandler.GetSingleFile)
 	server.GET("/files/:id/status", filesHandler.GetFileStatus)
-}
+	server.GET("/files/:id/content", filesHandler.GetFileContent)
+	server.GET("/files/:id/processed", filesHandler.GetProcessedContent)
+	server.DELETE("/files/:id", filesHandler.DeleteFile)
+	server.POST("/files/:id/restore", filesHandler.RestoreFile)
 
-func health(context *gin.Context) {
-	context.JSON(http.StatusOK, gin.H{
-		"message": "Hello World!",
-	})
-}
\ No newline at end of file
+	tus := server.Group("/files/tus", handlers.RequireTusResumable)
+	tus.OPTIONS("", tusHandler.Options)
+	tus.POST("", tusHandler.Create)
+	tus.HEAD("/:id", tusHandler.Head)
+	tus.PATCH("/:id", tusHandler.Patch)
+	tus.DELETE("/:id", tusHandler.Delete)
+}
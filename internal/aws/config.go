@@ -0,0 +1,131 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"s3-analytics/internal/config"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+)
+
+// ClientFactory builds every AWS client from one shared aws.Config, so
+// region, credentials, retries, timeouts and middleware are set up once.
+type ClientFactory struct {
+	Config   awssdk.Config
+	settings config.AWSConfig
+}
+
+// NewClientFactory loads the SDK configuration with settings applied on top
+// of the default chain. apiOptions are added to every client's middleware.
+func NewClientFactory(ctx context.Context, settings config.AWSConfig, apiOptions ...func(*middleware.Stack) error) (*ClientFactory, error) {
+	httpClient := awshttp.NewBuildableClient().
+		WithDialerOptions(func(d *net.Dialer) {
+			if settings.ConnectTimeout > 0 {
+				d.Timeout = settings.ConnectTimeout
+			}
+		}).
+		// Bounds each attempt up to the response headers only, so streaming
+		// large objects is not cut off.
+		WithTransportOptions(func(t *http.Transport) {
+			t.ResponseHeaderTimeout = settings.ResponseTimeout
+		})
+
+	loadOptions := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithHTTPClient(httpClient),
+	}
+
+	if settings.Region != "" {
+		loadOptions = append(loadOptions, awsconfig.WithRegion(settings.Region))
+	}
+
+	if settings.RetryMode != "" {
+		loadOptions = append(loadOptions, awsconfig.WithRetryMode(awssdk.RetryMode(settings.RetryMode)))
+	}
+
+	if settings.MaxAttempts > 0 {
+		loadOptions = append(loadOptions, awsconfig.WithRetryMaxAttempts(settings.MaxAttempts))
+	}
+
+	if settings.AccessKeyID != "" {
+		loadOptions = append(loadOptions, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(settings.AccessKeyID, settings.SecretAccessKey, settings.SessionToken)))
+	}
+
+	if settings.Endpoint != "" {
+		loadOptions = append(loadOptions, awsconfig.WithBaseEndpoint(settings.Endpoint))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, loadOptions...)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	if settings.RoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), settings.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = settings.RoleSessionName
+			if settings.RoleExternalID != "" {
+				o.ExternalID = &settings.RoleExternalID
+			}
+		})
+		cfg.Credentials = awssdk.NewCredentialsCache(provider)
+	}
+
+	// Every SDK call becomes a child span of the request that made it.
+	otelaws.AppendMiddlewares(&cfg.APIOptions)
+	cfg.APIOptions = append(cfg.APIOptions, apiOptions...)
+
+	return &ClientFactory{Config: cfg, settings: settings}, nil
+}
+
+func (f *ClientFactory) NewS3Client(bucket string) *S3Client {
+	client := s3.NewFromConfig(f.Config, func(o *s3.Options) {
+		// MinIO and most other S3 stand-ins only serve path-style requests.
+		o.UsePathStyle = f.settings.S3PathStyle
+		if f.settings.S3Endpoint != "" {
+			o.BaseEndpoint = &f.settings.S3Endpoint
+		}
+	})
+
+	return &S3Client{
+		Client: client,
+		Bucket: bucket,
+	}
+}
+
+func (f *ClientFactory) NewDynamoDBClient(tableName string) *DynamoDBClient {
+	client := dynamodb.NewFromConfig(f.Config, func(o *dynamodb.Options) {
+		if f.settings.DynamoDBEndpoint != "" {
+			o.BaseEndpoint = &f.settings.DynamoDBEndpoint
+		}
+	})
+
+	return &DynamoDBClient{
+		Client:    client,
+		TableName: tableName,
+	}
+}
+
+func (f *ClientFactory) NewCloudWatchClient() *CloudWatchClient {
+	client := cloudwatch.NewFromConfig(f.Config, func(o *cloudwatch.Options) {
+		if f.settings.CloudWatchEndpoint != "" {
+			o.BaseEndpoint = &f.settings.CloudWatchEndpoint
+		}
+	})
+
+	return &CloudWatchClient{
+		Client: client,
+	}
+}
@@ -1,29 +1,10 @@
 package aws
 
 import (
-	"context"
-	"log"
-
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 )
 
 type DynamoDBClient struct {
-	Client *dynamodb.Client
+	Client    *dynamodb.Client
 	TableName string
 }
-
-func NewDynamoDBClient(ctx context.Context, tableName string) *DynamoDBClient {
-	cfg, err := config.LoadDefaultConfig(ctx)
-
-	if err != nil {
-		log.Fatalf("Unable to load AWS config: %v", err)
-	}
-
-	client := dynamodb.NewFromConfig(cfg)
-
-	return &DynamoDBClient{
-		Client: client,
-		TableName: tableName,
-	}
-}
\ No newline at end of file
@@ -1,39 +1,329 @@
-// Loads environment variables and creates configuration
-
+// Package config loads the configuration shared by the API and the
+// processor. Every setting can come from a YAML file, the environment (a
+// .env file included) or a command-line flag. Later sources win: defaults,
+// then the file, then the environment, then flags.
 package config
 
 import (
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
+const (
+	BackendAWS    = "aws"
+	BackendMemory = "memory"
+	BackendLocal  = "local"
+)
+
+// Where request metrics are sent.
+const (
+	MetricsSinkCloudWatch = "cloudwatch"
+	// MetricsSinkEMF writes CloudWatch Embedded Metric Format log lines
+	// instead of calling PutMetricData.
+	MetricsSinkEMF        = "emf"
+	MetricsSinkPrometheus = "prometheus"
+	MetricsSinkBoth       = "both"
+)
+
+// Span exporters TraceExporter accepts.
+const (
+	TraceExporterNone   = "none"
+	TraceExporterStdout = "stdout"
+	TraceExporterOTLP   = "otlp"
+)
+
 type Config struct {
-	Bucket string
+	Backend   string
+	Bucket    string
 	TableName string
+	// DataDir is where the local backend keeps blobs and its metadata database.
+	DataDir string
+
+	// ListenAddress is the API's host:port.
+	ListenAddress     string
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout is how long in-flight requests get to finish after
+	// SIGTERM.
+	ShutdownTimeout time.Duration
+
+	// MaxUploadSize is the largest upload accepted, in bytes. Zero leaves
+	// only the storage backend's own limit.
+	MaxUploadSize int64
+
+	// IdempotencyTableName is the DynamoDB table remembering Idempotency-Key
+	// uploads on the aws backend; its TTL attribute should be expiresAt.
+	// Empty turns Idempotency-Key support off there. The other backends keep
+	// keys next to their metadata.
+	IdempotencyTableName string
+	// IdempotencyTTL is how long an Idempotency-Key is remembered.
+	IdempotencyTTL time.Duration
+	// IdempotencyLease is how long an upload in progress holds its key
+	// between renewals. A retry after the lease runs out, as when the
+	// server died mid-upload, is processed afresh.
+	IdempotencyLease time.Duration
+
+	// LogLevel is debug, info, warn or error.
+	LogLevel string
+
+	// ProcessorWorker runs the file processor inside the API process instead
+	// of relying on the EventBridge-triggered Lambda.
+	ProcessorWorker bool
+	// PurgeGracePeriod is how long a soft-deleted file can be restored.
+	PurgeGracePeriod time.Duration
+	// PurgeInterval is how often deleted files are purged; zero disables it.
+	PurgeInterval time.Duration
+	// ReconcileInterval is how often the API reconciles the bucket with the
+	// metadata table; zero disables it. The reconcile subcommand runs it
+	// once.
+	ReconcileInterval time.Duration
+	// ReconcileStuckAfter is how long a file may take to be processed, and
+	// an object may go without a record, before reconciliation reports it.
+	ReconcileStuckAfter time.Duration
+	// ReconcileAbandonAfter is how long a pending upload may go without
+	// storing anything or being written to before reconciliation reports
+	// it.
+	ReconcileAbandonAfter time.Duration
+	// ReconcileRepair fixes what reconciliation finds instead of only
+	// reporting it.
+	ReconcileRepair bool
+	// ReconcileBackfill repairs orphaned raw objects by recreating their
+	// records rather than deleting them.
+	ReconcileBackfill bool
+	// TraceExporter is where spans go: otlp, stdout or none.
+	TraceExporter string
+	// MetricsSink is cloudwatch, emf, prometheus or both (cloudwatch and
+	// prometheus). It defaults to cloudwatch on the aws backend; the other
+	// backends log or keep metrics in memory unless a sink is set.
+	MetricsSink string
+	// MetricsFlushInterval is how often buffered CloudWatch metrics are
+	// published.
+	MetricsFlushInterval time.Duration
+	// MetricsQueueSize bounds the metrics waiting to be published; any beyond
+	// it are dropped and counted.
+	MetricsQueueSize int
+
+	AWS AWSConfig
+
+	// PrintConfig is set by --print-config: the caller should print the
+	// configuration and exit instead of starting.
+	PrintConfig bool
+
+	settings []setting
+}
+
+// AWSConfig holds the settings shared by every AWS client. Empty fields
+// leave the SDK's own defaults and credential chain in place.
+type AWSConfig struct {
+	Region string
+	// Endpoint replaces the endpoint of every service, for stand-ins such as
+	// LocalStack. The per-service endpoints take precedence over it.
+	Endpoint           string
+	S3Endpoint         string
+	DynamoDBEndpoint   string
+	CloudWatchEndpoint string
+	// S3PathStyle addresses buckets as a path instead of a subdomain, as
+	// MinIO and LocalStack expect.
+	S3PathStyle bool
+
+	// Static credentials, mainly for MinIO and DynamoDB Local.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// RoleARN, when set, is assumed with the credentials above or the
+	// default chain, and its temporary credentials are used instead.
+	RoleARN         string
+	RoleExternalID  string
+	RoleSessionName string
+
+	// RetryMode is standard or adaptive; adaptive also rate-limits the
+	// client when AWS throttles it. MaxAttempts of zero keeps the SDK default.
+	RetryMode   string
+	MaxAttempts int
+	// ConnectTimeout bounds dialing; ResponseTimeout bounds the wait for
+	// response headers on each attempt. Zero leaves them unbounded.
+	ConnectTimeout  time.Duration
+	ResponseTimeout time.Duration
 }
 
-func LoadConfig() *Config {
-	err := godotenv.Load()
+// Load builds the configuration from the YAML file named by --config or
+// CONFIG_FILE, the environment and args. Every invalid setting is reported
+// in the returned error, not just the first.
+func Load(args []string) (*Config, error) {
+	// A missing .env is fine; the variables may come from the environment.
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load .env: %w", err)
+	}
+
+	c := &Config{}
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	c.settings = bind(flags, c)
+
+	file := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	flags.BoolVar(&c.PrintConfig, "print-config", false, "print the configuration, with secrets redacted, and exit")
 
-	if err != nil {
-		log.Fatalf("Could not retrieve environment variables: %w.", err)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
 	}
 
-	bucket := os.Getenv("BUCKET_NAME")
-	tableName := os.Getenv("TABLE_NAME")
+	// Flags are parsed first to find the file; keep their values so they can
+	// be applied again over the file and the environment.
+	fromFlags := map[string]string{}
+	flags.Visit(func(f *flag.Flag) { fromFlags[f.Name] = f.Value.String() })
+
+	set := map[string]bool{}
+	var errs []error
+
+	if *file != "" {
+		fromFile, err := readFile(*file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range slices.Sorted(maps.Keys(fromFile)) {
+			s, ok := c.setting(key)
 
-	if bucket == "" {
-		log.Fatal("Could not retrieve Bucket.")
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown setting %q", *file, key))
+				continue
+			}
+
+			errs = append(errs, s.set(*file+": "+key, fromFile[key], set))
+		}
+	}
+
+	for _, s := range c.settings {
+		// Empty variables count as unset, as they usually come from
+		// templated environments.
+		if value := os.Getenv(s.env); value != "" {
+			errs = append(errs, s.set(s.env, value, set))
+		}
+	}
+
+	for _, s := range c.settings {
+		if value, ok := fromFlags[s.key]; ok {
+			errs = append(errs, s.set("--"+s.key, value, set))
+		}
+	}
+
+	// Without EventBridge nothing else would process local uploads.
+	if !set["processor.worker"] {
+		c.ProcessorWorker = c.Backend != BackendAWS
 	}
 
-	if tableName == "" {
-		log.Fatal("Could not retrieve TableName.")
+	if !set["metrics.sink"] && c.Backend == BackendAWS {
+		c.MetricsSink = MetricsSinkCloudWatch
 	}
 
-	return &Config{
-		Bucket:     bucket,
-		TableName: 	tableName,
+	errs = append(errs, c.validate()...)
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
 	}
-}
\ No newline at end of file
+	return c, nil
+}
+
+// Level returns LogLevel as a slog level.
+func (c *Config) Level() slog.Level {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.LogLevel))
+	return level
+}
+
+// validate returns every problem with the loaded values.
+func (c *Config) validate() []error {
+	var errs []error
+
+	check := func(ok bool, key, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", c.label(key), fmt.Sprintf(format, args...)))
+		}
+	}
+
+	oneOf := func(key, value string, allowed ...string) {
+		check(slices.Contains(allowed, value), key, "unknown value %q, want %s", value, strings.Join(allowed, ", "))
+	}
+
+	oneOf("backend", c.Backend, BackendAWS, BackendLocal, BackendMemory)
+
+	if c.Backend == BackendAWS {
+		check(c.Bucket != "", "bucket", "required by the aws backend")
+		check(c.TableName != "", "tableName", "required by the aws backend")
+	}
+
+	if c.Backend == BackendLocal {
+		check(c.DataDir != "", "dataDir", "required by the local backend")
+	}
+
+	check(c.ListenAddress != "", "server.listenAddress", "must not be empty")
+	check(c.ReadHeaderTimeout >= 0, "server.readHeaderTimeout", "must not be negative")
+	check(c.IdleTimeout >= 0, "server.idleTimeout", "must not be negative")
+	check(c.ShutdownTimeout > 0, "server.shutdownTimeout", "must be positive")
+	check(c.MaxUploadSize >= 0, "upload.maxSize", "must not be negative")
+	check(c.IdempotencyTTL > 0, "idempotency.ttl", "must be positive")
+	check(c.IdempotencyLease > 0, "idempotency.lease", "must be positive")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.LogLevel)) == nil, "log.level", "unknown level %q, want debug, info, warn or error", c.LogLevel)
+
+	check(c.PurgeGracePeriod >= 0, "purge.gracePeriod", "must not be negative")
+	check(c.PurgeInterval >= 0, "purge.interval", "must not be negative")
+	check(c.ReconcileInterval >= 0, "reconcile.interval", "must not be negative")
+	check(c.ReconcileStuckAfter > 0, "reconcile.stuckAfter", "must be positive")
+	check(c.ReconcileAbandonAfter > 0, "reconcile.abandonAfter", "must be positive")
+
+	oneOf("trace.exporter", c.TraceExporter, TraceExporterNone, TraceExporterStdout, TraceExporterOTLP)
+
+	if c.MetricsSink != "" {
+		oneOf("metrics.sink", c.MetricsSink, MetricsSinkCloudWatch, MetricsSinkEMF, MetricsSinkPrometheus, MetricsSinkBoth)
+	}
+
+	check(c.MetricsFlushInterval > 0, "metrics.flushInterval", "must be positive")
+	check(c.MetricsQueueSize > 0, "metrics.queueSize", "must be positive")
+
+	endpoint := func(key, value string) {
+		if value == "" {
+			return
+		}
+
+		u, err := url.Parse(value)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", key, "%q is not an http(s) URL", value)
+	}
+
+	endpoint("aws.endpoint", c.AWS.Endpoint)
+	endpoint("aws.s3Endpoint", c.AWS.S3Endpoint)
+	endpoint("aws.dynamoDBEndpoint", c.AWS.DynamoDBEndpoint)
+	endpoint("aws.cloudWatchEndpoint", c.AWS.CloudWatchEndpoint)
+
+	if c.AWS.RetryMode != "" {
+		oneOf("aws.retryMode", c.AWS.RetryMode, "standard", "adaptive")
+	}
+
+	check(c.AWS.MaxAttempts >= 0, "aws.maxAttempts", "must not be negative")
+	check(c.AWS.ConnectTimeout >= 0, "aws.connectTimeout", "must not be negative")
+	check(c.AWS.ResponseTimeout >= 0, "aws.responseTimeout", "must not be negative")
+
+	check((c.AWS.AccessKeyID == "") == (c.AWS.SecretAccessKey == ""), "aws.secretAccessKey", "must be set together with aws.accessKeyId")
+
+	return errs
+}
+
+// label names a setting in error messages by its key and variable.
+func (c *Config) label(key string) string {
+	if s, ok := c.setting(key); ok {
+		return fmt.Sprintf("%s ($%s)", key, s.env)
+	}
+	return key
+}
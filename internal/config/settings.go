@@ -0,0 +1,229 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secret values in Print.
+const redacted = "REDACTED"
+
+// setting is one configuration value. Its key is both the dotted YAML path
+// and the flag name, so aws.region is set by
+//
+//	aws:
+//	  region: eu-west-1
+//
+// in the file, by AWS_REGION in the environment or by --aws.region.
+type setting struct {
+	key    string
+	env    string
+	kind   string
+	secret bool
+	value  flag.Value
+}
+
+// set parses value from source into the setting.
+func (s setting) set(source, value string, set map[string]bool) error {
+	if err := s.value.Set(value); err != nil {
+		return fmt.Errorf("%s: invalid %s %q", source, s.kind, value)
+	}
+
+	set[s.key] = true
+	return nil
+}
+
+// bind registers every setting of c, with its default, as a flag.
+func bind(flags *flag.FlagSet, c *Config) []setting {
+	b := &binder{flags: flags}
+
+	b.string(&c.Backend, "backend", "BACKEND", BackendAWS, "storage and metadata backend: aws, local or memory")
+	b.string(&c.Bucket, "bucket", "BUCKET_NAME", "", "S3 bucket for raw and processed files")
+	b.string(&c.TableName, "tableName", "TABLE_NAME", "", "DynamoDB table for file metadata")
+	b.string(&c.DataDir, "dataDir", "LOCAL_DATA_DIR", "data", "directory for the local backend's blobs and metadata")
+
+	b.string(&c.ListenAddress, "server.listenAddress", "LISTEN_ADDRESS", ":8080", "address the API listens on")
+	b.duration(&c.ReadHeaderTimeout, "server.readHeaderTimeout", "READ_HEADER_TIMEOUT", 10*time.Second, "time allowed to read request headers")
+	b.duration(&c.IdleTimeout, "server.idleTimeout", "IDLE_TIMEOUT", 2*time.Minute, "how long idle keep-alive connections stay open")
+	b.duration(&c.ShutdownTimeout, "server.shutdownTimeout", "SHUTDOWN_TIMEOUT", 30*time.Second, "time in-flight requests get to finish on shutdown")
+
+	b.int64(&c.MaxUploadSize, "upload.maxSize", "UPLOAD_MAX_SIZE", 0, "largest accepted upload in bytes; 0 for the storage limit")
+
+	b.string(&c.IdempotencyTableName, "idempotency.tableName", "IDEMPOTENCY_TABLE_NAME", "", "DynamoDB table for Idempotency-Key uploads; empty disables them on the aws backend")
+	b.duration(&c.IdempotencyTTL, "idempotency.ttl", "IDEMPOTENCY_TTL", 24*time.Hour, "how long an Idempotency-Key is remembered")
+	b.duration(&c.IdempotencyLease, "idempotency.lease", "IDEMPOTENCY_LEASE", 5*time.Minute, "how long an upload in progress holds its Idempotency-Key between renewals")
+
+	b.string(&c.LogLevel, "log.level", "LOG_LEVEL", "info", "debug, info, warn or error")
+
+	b.bool(&c.ProcessorWorker, "processor.worker", "PROCESSOR_WORKER", false, "process uploads inside the API (default true except on the aws backend)")
+	b.duration(&c.PurgeGracePeriod, "purge.gracePeriod", "PURGE_GRACE_PERIOD", 7*24*time.Hour, "how long deleted files can be restored")
+	b.duration(&c.PurgeInterval, "purge.interval", "PURGE_INTERVAL", time.Hour, "how often deleted files are purged; 0 disables purging")
+	b.duration(&c.ReconcileInterval, "reconcile.interval", "RECONCILE_INTERVAL", 0, "how often the bucket is reconciled with the metadata table; 0 disables it")
+	b.duration(&c.ReconcileStuckAfter, "reconcile.stuckAfter", "RECONCILE_STUCK_AFTER", time.Hour, "how long processing may take before a file is reported as stuck")
+	b.duration(&c.ReconcileAbandonAfter, "reconcile.abandonAfter", "RECONCILE_ABANDON_AFTER", 24*time.Hour, "how long a pending upload may store nothing and see no activity before it is reported as abandoned")
+	b.bool(&c.ReconcileRepair, "reconcile.repair", "RECONCILE_REPAIR", false, "repair what reconciliation finds instead of only reporting it")
+	b.bool(&c.ReconcileBackfill, "reconcile.backfill", "RECONCILE_BACKFILL", false, "repair orphaned raw objects by recreating their records instead of deleting them")
+
+	b.string(&c.TraceExporter, "trace.exporter", "TRACE_EXPORTER", TraceExporterNone, "span exporter: none, stdout or otlp")
+
+	b.string(&c.MetricsSink, "metrics.sink", "METRICS_SINK", "", "cloudwatch, emf, prometheus or both (default cloudwatch on the aws backend)")
+	b.duration(&c.MetricsFlushInterval, "metrics.flushInterval", "METRICS_FLUSH_INTERVAL", 15*time.Second, "how often CloudWatch metrics are published")
+	b.int(&c.MetricsQueueSize, "metrics.queueSize", "METRICS_QUEUE_SIZE", 10000, "metrics buffered before new ones are dropped")
+
+	b.string(&c.AWS.Region, "aws.region", "AWS_REGION", "", "AWS region")
+	b.string(&c.AWS.Endpoint, "aws.endpoint", "AWS_ENDPOINT_URL", "", "endpoint URL for every AWS service")
+	b.string(&c.AWS.S3Endpoint, "aws.s3Endpoint", "AWS_ENDPOINT_URL_S3", "", "S3 endpoint URL")
+	b.string(&c.AWS.DynamoDBEndpoint, "aws.dynamoDBEndpoint", "AWS_ENDPOINT_URL_DYNAMODB", "", "DynamoDB endpoint URL")
+	b.string(&c.AWS.CloudWatchEndpoint, "aws.cloudWatchEndpoint", "AWS_ENDPOINT_URL_CLOUDWATCH", "", "CloudWatch endpoint URL")
+	b.bool(&c.AWS.S3PathStyle, "aws.s3PathStyle", "AWS_S3_USE_PATH_STYLE", false, "use path-style S3 requests, for MinIO and LocalStack")
+	b.string(&c.AWS.AccessKeyID, "aws.accessKeyId", "AWS_ACCESS_KEY_ID", "", "static AWS access key ID")
+	b.secret(&c.AWS.SecretAccessKey, "aws.secretAccessKey", "AWS_SECRET_ACCESS_KEY", "static AWS secret access key")
+	b.secret(&c.AWS.SessionToken, "aws.sessionToken", "AWS_SESSION_TOKEN", "static AWS session token")
+	// Not AWS_ROLE_ARN: the SDK already uses that for web identity roles.
+	b.string(&c.AWS.RoleARN, "aws.roleArn", "ASSUME_ROLE_ARN", "", "IAM role to assume for every AWS call")
+	b.secret(&c.AWS.RoleExternalID, "aws.roleExternalId", "ASSUME_ROLE_EXTERNAL_ID", "external ID required by the assumed role")
+	b.string(&c.AWS.RoleSessionName, "aws.roleSessionName", "ASSUME_ROLE_SESSION_NAME", "s3-analytics", "session name for the assumed role")
+	b.string(&c.AWS.RetryMode, "aws.retryMode", "AWS_RETRY_MODE", "standard", "SDK retry mode: standard or adaptive")
+	b.int(&c.AWS.MaxAttempts, "aws.maxAttempts", "AWS_MAX_ATTEMPTS", 0, "attempts per AWS call including the first; 0 for the SDK default")
+	b.duration(&c.AWS.ConnectTimeout, "aws.connectTimeout", "AWS_CONNECT_TIMEOUT", 5*time.Second, "time allowed to connect to AWS")
+	b.duration(&c.AWS.ResponseTimeout, "aws.responseTimeout", "AWS_RESPONSE_TIMEOUT", 30*time.Second, "time allowed per attempt until response headers arrive")
+
+	return b.settings
+}
+
+type binder struct {
+	flags    *flag.FlagSet
+	settings []setting
+}
+
+func (b *binder) add(key, env, kind string, secret bool) {
+	b.settings = append(b.settings, setting{
+		key:    key,
+		env:    env,
+		kind:   kind,
+		secret: secret,
+		value:  b.flags.Lookup(key).Value,
+	})
+}
+
+func (b *binder) string(p *string, key, env, value, usage string) {
+	b.flags.StringVar(p, key, value, usage+" ($"+env+")")
+	b.add(key, env, "string", false)
+}
+
+func (b *binder) secret(p *string, key, env, usage string) {
+	b.flags.StringVar(p, key, "", usage+" ($"+env+")")
+	b.add(key, env, "string", true)
+}
+
+func (b *binder) bool(p *bool, key, env string, value bool, usage string) {
+	b.flags.BoolVar(p, key, value, usage+" ($"+env+")")
+	b.add(key, env, "boolean", false)
+}
+
+func (b *binder) int(p *int, key, env string, value int, usage string) {
+	b.flags.IntVar(p, key, value, usage+" ($"+env+")")
+	b.add(key, env, "integer", false)
+}
+
+func (b *binder) int64(p *int64, key, env string, value int64, usage string) {
+	b.flags.Int64Var(p, key, value, usage+" ($"+env+")")
+	b.add(key, env, "integer", false)
+}
+
+func (b *binder) duration(p *time.Duration, key, env string, value time.Duration, usage string) {
+	b.flags.DurationVar(p, key, value, usage+" ($"+env+")")
+	b.add(key, env, "duration", false)
+}
+
+func (c *Config) setting(key string) (setting, bool) {
+	for _, s := range c.settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// readFile reads a YAML configuration file into dotted keys and their values.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var root map[string]any
+
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	flatten("", root, values)
+
+	return values, nil
+}
+
+func flatten(prefix string, node map[string]any, values map[string]string) {
+	for key, value := range node {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		switch v := value.(type) {
+		case map[string]any:
+			flatten(key, v, values)
+		case nil:
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+}
+
+// Print writes the configuration as YAML that Load accepts, with secrets
+// redacted.
+func (c *Config) Print(w io.Writer) error {
+	root := map[string]any{}
+
+	for _, s := range c.settings {
+		value := s.value.(flag.Getter).Get()
+
+		switch v := value.(type) {
+		case time.Duration:
+			value = v.String()
+		case string:
+			if s.secret && v != "" {
+				value = redacted
+			}
+		}
+
+		node := root
+		path := strings.Split(s.key, ".")
+
+		for _, name := range path[:len(path)-1] {
+			child, ok := node[name].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				node[name] = child
+			}
+			node = child
+		}
+
+		node[path[len(path)-1]] = value
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+
+	if err := encoder.Encode(root); err != nil {
+		return fmt.Errorf("failed to print config: %w", err)
+	}
+	return encoder.Close()
+}
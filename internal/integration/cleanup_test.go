@@ -0,0 +1,173 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"s3-analytics/internal/processor"
+	"s3-analytics/internal/services"
+)
+
+// failingMetadata fails UpdateItem, and CreateItem too with failCreate, and
+// records the ids it was asked to create.
+type failingMetadata struct {
+	services.MetadataStore
+	failCreate bool
+
+	mu      sync.Mutex
+	created []string
+}
+
+func (f *failingMetadata) CreateItem(ctx context.Context, metadata *services.FileMetadata) error {
+	f.mu.Lock()
+	f.created = append(f.created, metadata.ID)
+	f.mu.Unlock()
+
+	if f.failCreate {
+		return fmt.Errorf("%w: injected create failure", services.ErrUnavailable)
+	}
+
+	return f.MetadataStore.CreateItem(ctx, metadata)
+}
+
+func (f *failingMetadata) UpdateItem(ctx context.Context, id string, update services.FileUpdate) error {
+	return fmt.Errorf("%w: injected update failure", services.ErrUnavailable)
+}
+
+// failingStorage stores the object, then reports the upload as failed, as
+// when the connection drops before S3's response arrives.
+type failingStorage struct {
+	services.BlobStore
+
+	mu   sync.Mutex
+	keys []string
+}
+
+func (f *failingStorage) PutObject(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	if err := f.BlobStore.PutObject(ctx, key, body, metadata); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.keys = append(f.keys, key)
+	f.mu.Unlock()
+
+	return fmt.Errorf("%w: injected upload failure", services.ErrUnavailable)
+}
+
+func TestFailedMetadataUpdateLeavesNoOrphans(t *testing.T) {
+	metadata := &failingMetadata{}
+
+	e := newEnvWith(t, envHooks{metadata: func(store services.MetadataStore) services.MetadataStore {
+		metadata.MetadataStore = store
+		return metadata
+	}})
+
+	if response := e.postFile("lost.txt", []byte("never recorded"), nil); response.Code != http.StatusServiceUnavailable {
+		t.Fatalf("POST /files: status %d, want 503: %s", response.Code, response.Body)
+	}
+
+	if len(metadata.created) != 1 {
+		t.Fatalf("%d records created, want 1", len(metadata.created))
+	}
+
+	e.assertNoTrace(metadata.created[0], "lost.txt")
+}
+
+func TestFailedEmptyResumableUploadLeavesNoOrphans(t *testing.T) {
+	metadata := &failingMetadata{failCreate: true}
+
+	e := newEnvWith(t, envHooks{metadata: func(store services.MetadataStore) services.MetadataStore {
+		metadata.MetadataStore = store
+		return metadata
+	}})
+
+	header := http.Header{
+		"Tus-Resumable":   {"1.0.0"},
+		"Upload-Length":   {"0"},
+		"Upload-Metadata": {"filename " + base64.StdEncoding.EncodeToString([]byte("empty.txt"))},
+	}
+
+	if response := e.do(http.MethodPost, "/files/tus", nil, header); response.Code != http.StatusServiceUnavailable {
+		t.Fatalf("POST /files/tus: status %d, want 503: %s", response.Code, response.Body)
+	}
+
+	if len(metadata.created) != 1 {
+		t.Fatalf("%d records created, want 1", len(metadata.created))
+	}
+
+	e.assertNoTrace(metadata.created[0], "empty.txt")
+}
+
+func TestFailedUploadLeavesNoOrphans(t *testing.T) {
+	storage := &failingStorage{}
+
+	e := newEnvWith(t, envHooks{storage: func(store services.BlobStore) services.BlobStore {
+		storage.BlobStore = store
+		return storage
+	}})
+
+	if response := e.postFile("dropped.txt", []byte("stored, then reported failed"), nil); response.Code != http.StatusServiceUnavailable {
+		t.Fatalf("POST /files: status %d, want 503: %s", response.Code, response.Body)
+	}
+
+	if len(storage.keys) != 1 {
+		t.Fatalf("%d objects stored, want 1", len(storage.keys))
+	}
+
+	id, err := processor.ParseFileID(storage.keys[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.assertNoTrace(id, "dropped.txt")
+}
+
+// assertNoTrace checks that neither the record nor the raw object of a
+// failed upload remain.
+func (e *env) assertNoTrace(id, filename string) {
+	e.t.Helper()
+
+	if _, err := e.metadata.GetFileById(e.t.Context(), id); !errors.Is(err, services.ErrNotFound) {
+		e.t.Errorf("record %s left after a failed upload: %v", id, err)
+	}
+
+	if _, err := e.storage.HeadObject(e.t.Context(), services.RawKey(id, filename)); !errors.Is(err, services.ErrNotFound) {
+		e.t.Errorf("raw object of %s left after a failed upload: %v", id, err)
+	}
+}
+
+func TestRejectedDirectUploadLeavesNoOrphans(t *testing.T) {
+	e := newEnv(t)
+
+	response := e.do(http.MethodPost, "/files/uploads", strings.NewReader(`{"filename": "short.txt", "size": 5}`), http.Header{"Content-Type": {"application/json"}})
+
+	if response.Code != http.StatusCreated {
+		t.Fatalf("POST /files/uploads: status %d: %s", response.Code, response.Body)
+	}
+
+	var created struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	}
+	decode(t, response, &created)
+
+	// The client's presigned PUT sends more than it declared.
+	e.putObject(created.Key, "more than five bytes")
+
+	if response := e.do(http.MethodPost, "/files/uploads/"+created.ID+"/complete", nil, nil); response.Code != http.StatusConflict {
+		t.Fatalf("POST /files/uploads/%s/complete: status %d, want 409: %s", created.ID, response.Code, response.Body)
+	}
+
+	e.assertNoTrace(created.ID, "short.txt")
+}
@@ -0,0 +1,117 @@
+//go:build integration
+
+package integration
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+
+	"s3-analytics/internal/services"
+)
+
+func TestDeclaredSha256SkipsTransfer(t *testing.T) {
+	e := newEnv(t)
+
+	content := []byte("large report, uploaded once")
+	digest := sha256.Sum256(content)
+	sum := hex.EncodeToString(digest[:])
+
+	if response := e.do(http.MethodHead, "/files/by-sha256/"+sum, nil, nil); response.Code != http.StatusNotFound {
+		t.Fatalf("HEAD /files/by-sha256 before any upload: status %d, want 404", response.Code)
+	}
+
+	if response := e.postForm([]string{"sha256", sum, "filename", "copy.txt"}, "", nil, nil); response.Code != http.StatusUnprocessableEntity {
+		t.Errorf("POST /files with an unknown sha256 and no content: status %d, want 422", response.Code)
+	}
+
+	original := e.upload("report.txt", content)
+	e.waitForState(original, services.StateDone)
+
+	if response := e.do(http.MethodHead, "/files/by-sha256/"+strings.ToUpper(sum), nil, nil); response.Code != http.StatusOK {
+		t.Fatalf("HEAD /files/by-sha256: status %d, want 200", response.Code)
+	}
+
+	response := e.postForm([]string{"sha256", sum, "filename", "copy.txt"}, "", nil, nil)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("POST /files with a known sha256: status %d: %s", response.Code, response.Body)
+	}
+
+	var copied uploadResponse
+	decode(t, response, &copied)
+
+	if !copied.Deduplicated || copied.ID == original {
+		t.Fatalf("POST /files with a known sha256 = %+v, want a new deduplicated file", copied)
+	}
+
+	source := e.getFile(original)
+	file := e.getFile(copied.ID)
+
+	if file.Filename != "copy.txt" || file.ProcessingState != services.StateDone || file.ProcessedKey != source.ProcessedKey || file.Size != source.Size {
+		t.Errorf("deduplicated file = %+v, want copy.txt sharing %+v", file, source)
+	}
+
+	if _, err := e.storage.HeadObject(t.Context(), services.RawKey(copied.ID, "copy.txt")); err == nil {
+		t.Error("deduplicated upload stored its own raw object")
+	}
+
+	download := e.do(http.MethodGet, "/files/"+copied.ID+"/content", nil, nil)
+
+	if download.Code != http.StatusOK || download.Body.String() != string(content) {
+		t.Errorf("GET /files/%s/content: status %d, body %q", copied.ID, download.Code, download.Body)
+	}
+
+	// Sending the bytes anyway is checked against the declared hash.
+	if response := e.postForm([]string{"sha256", sum}, "again.txt", content, nil); response.Code != http.StatusOK {
+		t.Errorf("POST /files with a known sha256 and matching content: status %d: %s", response.Code, response.Body)
+	}
+
+	if response := e.postForm([]string{"sha256", sum}, "forged.txt", []byte("other bytes"), nil); response.Code != http.StatusUnprocessableEntity {
+		t.Errorf("POST /files with a known sha256 and other content: status %d, want 422", response.Code)
+	}
+}
+
+func TestDeclaredSha256IsVerified(t *testing.T) {
+	e := newEnv(t)
+
+	wrong := strings.Repeat("ab", 32)
+
+	if response := e.postForm([]string{"sha256", wrong}, "new.txt", []byte("new content"), nil); response.Code != http.StatusUnprocessableEntity {
+		t.Errorf("POST /files with a mismatched sha256: status %d, want 422", response.Code)
+	}
+
+	if response := e.postForm([]string{"sha256", "not-a-hash"}, "new.txt", []byte("new content"), nil); response.Code != http.StatusUnprocessableEntity {
+		t.Errorf("POST /files with a malformed sha256: status %d, want 422", response.Code)
+	}
+
+	files, err := e.metadata.GetAllItems(t.Context())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 0 {
+		t.Errorf("%d files stored after rejected uploads, want 0", len(files))
+	}
+
+	content := []byte("declared correctly")
+	digest := sha256.Sum256(content)
+
+	response := e.postForm([]string{"sha256", hex.EncodeToString(digest[:])}, "right.txt", content, nil)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("POST /files with a matching sha256: status %d: %s", response.Code, response.Body)
+	}
+
+	var result uploadResponse
+	decode(t, response, &result)
+
+	if result.Deduplicated {
+		t.Error("first upload of new content reported as deduplicated")
+	}
+
+	e.waitForState(result.ID, services.StateDone)
+}
@@ -0,0 +1,11 @@
+// Package integration runs the API router, the AWS-backed services and the
+// processor together against local stand-ins for S3 and DynamoDB. The tests
+// are behind the integration build tag; run them with
+//
+//	make test-integration
+//
+// S3 is served in-process by gofakes3 unless AWS_ENDPOINT_URL_S3 points at a
+// MinIO server. DynamoDB needs DynamoDB Local at AWS_ENDPOINT_URL_DYNAMODB;
+// without it the metadata is kept by the in-memory store instead. Every run
+// creates its own bucket and table, so the stand-ins can be shared.
+package integration
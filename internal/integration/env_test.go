@@ -0,0 +1,361 @@
+//go:build integration
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"s3-analytics/internal/api"
+	"s3-analytics/internal/api/handlers"
+	"s3-analytics/internal/api/middleware"
+	"s3-analytics/internal/aws"
+	"s3-analytics/internal/config"
+	"s3-analytics/internal/logging"
+	"s3-analytics/internal/processor"
+	"s3-analytics/internal/services"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+// env is one API wired to fresh stand-ins, with the processor running as an
+// in-process worker.
+type env struct {
+	t           *testing.T
+	server      *gin.Engine
+	storage     services.BlobStore
+	metadata    services.MetadataStore
+	idempotency services.IdempotencyStore
+}
+
+// envHooks wrap the stores the handlers use, e.g. to inject failures. The
+// processor and the env's own fields keep the unwrapped stores.
+type envHooks struct {
+	storage  func(services.BlobStore) services.BlobStore
+	metadata func(services.MetadataStore) services.MetadataStore
+}
+
+func newEnv(t *testing.T) *env {
+	t.Helper()
+
+	return newEnvWith(t, envHooks{})
+}
+
+func newEnvWith(t *testing.T, hooks envHooks) *env {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	settings := config.AWSConfig{
+		Region:           "us-east-1",
+		S3Endpoint:       os.Getenv("AWS_ENDPOINT_URL_S3"),
+		DynamoDBEndpoint: os.Getenv("AWS_ENDPOINT_URL_DYNAMODB"),
+		S3PathStyle:      true,
+		AccessKeyID:      getenv("AWS_ACCESS_KEY_ID", "test"),
+		SecretAccessKey:  getenv("AWS_SECRET_ACCESS_KEY", "test"),
+		MaxAttempts:      1,
+	}
+
+	if settings.S3Endpoint == "" {
+		fake := httptest.NewServer(gofakes3.New(s3mem.New()).Server())
+		t.Cleanup(fake.Close)
+		settings.S3Endpoint = fake.URL
+	}
+
+	clients, err := aws.NewClientFactory(ctx, settings)
+
+	if err != nil {
+		t.Fatalf("failed to set up AWS clients: %v", err)
+	}
+
+	suffix := strings.ReplaceAll(uuid.NewString(), "-", "")[:12]
+
+	s3Client := clients.NewS3Client("integration-" + suffix)
+	createBucket(t, s3Client)
+	storage := services.NewS3Service(s3Client)
+
+	var metadata services.MetadataStore
+	var idempotency services.IdempotencyStore
+
+	if settings.DynamoDBEndpoint != "" {
+		dynamoDBClient := clients.NewDynamoDBClient("integration-" + suffix)
+		createTable(t, dynamoDBClient)
+		metadata = services.NewDynamoDBService(dynamoDBClient)
+
+		idempotencyClient := clients.NewDynamoDBClient("integration-idempotency-" + suffix)
+		createIdempotencyTable(t, idempotencyClient)
+		idempotency = services.NewDynamoDBIdempotencyStore(idempotencyClient)
+	} else {
+		t.Log("AWS_ENDPOINT_URL_DYNAMODB is not set; using the in-memory metadata store.")
+		metadata = services.NewMemoryMetadataStore()
+		idempotency = services.NewMemoryIdempotencyStore()
+	}
+
+	worker := processor.NewWorker(processor.NewProcessor(storage, metadata), 100)
+	go worker.Run(ctx)
+
+	server := gin.New()
+	server.Use(
+		middleware.Trace(logging.NewStructuredLogger()),
+		middleware.Metrics(services.NewMemoryMetrics()),
+	)
+	handlerStorage, handlerMetadata := services.BlobStore(storage), metadata
+
+	if hooks.storage != nil {
+		handlerStorage = hooks.storage(storage)
+	}
+	if hooks.metadata != nil {
+		handlerMetadata = hooks.metadata(metadata)
+	}
+
+	uploadHandler := handlers.NewUploadHandler(handlerStorage, handlerMetadata, worker)
+	uploadHandler.Idempotency = idempotency
+
+	api.RegisterRoutes(server,
+		uploadHandler,
+		handlers.NewFilesHandler(handlerStorage, handlerMetadata),
+		handlers.NewTusHandler(handlerStorage, handlerMetadata, worker),
+		handlers.NewHealthHandler(handlerStorage, handlerMetadata),
+	)
+
+	return &env{t: t, server: server, storage: storage, metadata: metadata, idempotency: idempotency}
+}
+
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func createBucket(t *testing.T, c *aws.S3Client) {
+	t.Helper()
+
+	_, err := c.Client.CreateBucket(context.Background(), &s3.CreateBucketInput{
+		Bucket: awssdk.String(c.Bucket),
+	})
+
+	if err != nil {
+		t.Fatalf("failed to create bucket %s: %v", c.Bucket, err)
+	}
+}
+
+// createTable creates the metadata table with the indexes the deployment
+// stack defines.
+func createTable(t *testing.T, c *aws.DynamoDBClient) {
+	t.Helper()
+
+	stringAttribute := func(name string) types.AttributeDefinition {
+		return types.AttributeDefinition{AttributeName: awssdk.String(name), AttributeType: types.ScalarAttributeTypeS}
+	}
+	key := func(name string, keyType types.KeyType) types.KeySchemaElement {
+		return types.KeySchemaElement{AttributeName: awssdk.String(name), KeyType: keyType}
+	}
+
+	_, err := c.Client.CreateTable(context.Background(), &dynamodb.CreateTableInput{
+		TableName:   awssdk.String(c.TableName),
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			stringAttribute("id"),
+			stringAttribute("sha256"),
+			stringAttribute("processingState"),
+			stringAttribute("createdAt"),
+		},
+		KeySchema: []types.KeySchemaElement{key("id", types.KeyTypeHash)},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName:  awssdk.String(services.Sha256IndexName),
+				KeySchema:  []types.KeySchemaElement{key("sha256", types.KeyTypeHash)},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+			{
+				IndexName: awssdk.String(services.StateCreatedAtIndexName),
+				KeySchema: []types.KeySchemaElement{
+					key("processingState", types.KeyTypeHash),
+					key("createdAt", types.KeyTypeRange),
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("failed to create table %s: %v", c.TableName, err)
+	}
+
+	waitForTable(t, c)
+}
+
+// createIdempotencyTable creates a table for DynamoDBIdempotencyStore.
+func createIdempotencyTable(t *testing.T, c *aws.DynamoDBClient) {
+	t.Helper()
+
+	_, err := c.Client.CreateTable(context.Background(), &dynamodb.CreateTableInput{
+		TableName:   awssdk.String(c.TableName),
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: awssdk.String("idempotencyKey"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: awssdk.String("idempotencyKey"), KeyType: types.KeyTypeHash},
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("failed to create table %s: %v", c.TableName, err)
+	}
+
+	waitForTable(t, c)
+}
+
+// waitForTable waits for a new table to become active and drops it after
+// the test.
+func waitForTable(t *testing.T, c *aws.DynamoDBClient) {
+	t.Helper()
+
+	t.Cleanup(func() {
+		c.Client.DeleteTable(context.Background(), &dynamodb.DeleteTableInput{TableName: awssdk.String(c.TableName)})
+	})
+
+	waiter := dynamodb.NewTableExistsWaiter(c.Client)
+
+	if err := waiter.Wait(context.Background(), &dynamodb.DescribeTableInput{TableName: awssdk.String(c.TableName)}, time.Minute); err != nil {
+		t.Fatalf("table %s did not become active: %v", c.TableName, err)
+	}
+}
+
+// do sends a request through the router and returns the recorded response.
+func (e *env) do(method, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	e.t.Helper()
+
+	request := httptest.NewRequest(method, target, body)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	recorder := httptest.NewRecorder()
+	e.server.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+// postFile posts content as a multipart form file with the extra headers.
+func (e *env) postFile(filename string, content []byte, header http.Header) *httptest.ResponseRecorder {
+	e.t.Helper()
+
+	return e.postForm(nil, filename, content, header)
+}
+
+// postForm posts fields, given as name and value pairs, followed by content
+// as the file part unless filename is empty.
+func (e *env) postForm(fields []string, filename string, content []byte, header http.Header) *httptest.ResponseRecorder {
+	e.t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		form.WriteField(fields[i], fields[i+1])
+	}
+
+	if filename != "" {
+		part, err := form.CreateFormFile("file", filename)
+		if err != nil {
+			e.t.Fatal(err)
+		}
+		part.Write(content)
+	}
+	form.Close()
+
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", form.FormDataContentType())
+
+	return e.do(http.MethodPost, "/files", &body, header)
+}
+
+// uploadResponse is the body of a successful POST /files.
+type uploadResponse struct {
+	ID           string `json:"id"`
+	Key          string `json:"key"`
+	Deduplicated bool   `json:"deduplicated"`
+}
+
+// upload posts content as a multipart form file and returns the new file's
+// id.
+func (e *env) upload(filename string, content []byte) string {
+	e.t.Helper()
+
+	response := e.postFile(filename, content, nil)
+
+	if response.Code != http.StatusOK {
+		e.t.Fatalf("POST /files: status %d: %s", response.Code, response.Body)
+	}
+
+	var result uploadResponse
+	decode(e.t, response, &result)
+
+	if id, err := processor.ParseFileID(result.Key); err != nil || id != result.ID {
+		e.t.Fatalf("POST /files returned id %q and key %q", result.ID, result.Key)
+	}
+	return result.ID
+}
+
+// waitForState polls GET /files/:id/status until the file reaches state.
+func (e *env) waitForState(id string, state services.State) {
+	e.t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for {
+		response := e.do(http.MethodGet, "/files/"+id+"/status", nil, nil)
+
+		if response.Code != http.StatusOK {
+			e.t.Fatalf("GET /files/%s/status: status %d: %s", id, response.Code, response.Body)
+		}
+
+		var status struct {
+			Status services.State `json:"status"`
+		}
+		decode(e.t, response, &status)
+
+		if status.Status == state {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			e.t.Fatalf("file %s is still %q, want %q", id, status.Status, state)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func decode(t *testing.T, response *httptest.ResponseRecorder, v any) {
+	t.Helper()
+
+	if err := json.Unmarshal(response.Body.Bytes(), v); err != nil {
+		t.Fatalf("failed to decode response %q: %v", response.Body, err)
+	}
+}
@@ -0,0 +1,101 @@
+//go:build integration
+
+package integration
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"s3-analytics/internal/api/handlers"
+	"s3-analytics/internal/services"
+)
+
+func TestIdempotentUploadIsReplayed(t *testing.T) {
+	e := newEnv(t)
+
+	header := http.Header{handlers.IdempotencyKeyHeader: {"retry-me"}}
+	content := []byte("uploaded once")
+
+	first := e.postFile("once.txt", content, header)
+
+	if first.Code != http.StatusOK {
+		t.Fatalf("first POST /files: status %d: %s", first.Code, first.Body)
+	}
+
+	retry := e.postFile("once.txt", content, header)
+
+	if retry.Code != http.StatusOK || retry.Body.String() != first.Body.String() {
+		t.Errorf("retried POST /files: status %d, body %s; want the original %s", retry.Code, retry.Body, first.Body)
+	}
+
+	if retry.Header().Get(handlers.IdempotentReplayedHeader) != "true" {
+		t.Errorf("retried POST /files is missing %s", handlers.IdempotentReplayedHeader)
+	}
+
+	if other := e.postFile("once.txt", []byte("something else"), header); other.Code != http.StatusConflict {
+		t.Errorf("POST /files with a reused key and new content: status %d, want 409", other.Code)
+	}
+
+	files, err := e.metadata.GetAllItems(t.Context())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Errorf("%d files stored, want 1", len(files))
+	}
+
+	fresh := e.postFile("once.txt", content, http.Header{handlers.IdempotencyKeyHeader: {"another-key"}})
+
+	if fresh.Code != http.StatusOK || fresh.Header().Get(handlers.IdempotentReplayedHeader) != "" {
+		t.Errorf("POST /files with a new key: status %d, replayed %q", fresh.Code, fresh.Header().Get(handlers.IdempotentReplayedHeader))
+	}
+}
+
+func TestStaleIdempotencyClaimCannotTouchNewerOne(t *testing.T) {
+	e := newEnv(t)
+	ctx := t.Context()
+	store := e.idempotency
+
+	// The first claim's lease has already run out, so a retry takes over.
+	if _, err := store.Claim(ctx, "stale", "first", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("first claim: %v", err)
+	}
+
+	if _, err := store.Claim(ctx, "stale", "second", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("claim after the lease ran out: %v", err)
+	}
+
+	if err := store.Renew(ctx, "stale", "first", time.Now().Add(time.Minute)); !errors.Is(err, services.ErrConflict) {
+		t.Errorf("stale renew: %v, want ErrConflict", err)
+	}
+
+	if err := store.Complete(ctx, services.IdempotencyRecord{Key: "stale", Token: "first", StatusCode: http.StatusOK, ExpiresAt: time.Now().Add(time.Hour)}); !errors.Is(err, services.ErrConflict) {
+		t.Errorf("stale complete: %v, want ErrConflict", err)
+	}
+
+	if err := store.Release(ctx, "stale", "first"); !errors.Is(err, services.ErrConflict) {
+		t.Errorf("stale release: %v, want ErrConflict", err)
+	}
+
+	existing, err := store.Claim(ctx, "stale", "third", time.Now().Add(time.Minute))
+
+	if !errors.Is(err, services.ErrConflict) || existing.Token != "second" || existing.Completed() {
+		t.Fatalf("claim while held: %+v, %v; want the second claim's record and ErrConflict", existing, err)
+	}
+
+	if err := store.Renew(ctx, "stale", "second", time.Now().Add(time.Minute)); err != nil {
+		t.Errorf("renew: %v", err)
+	}
+
+	if err := store.Release(ctx, "stale", "second"); err != nil {
+		t.Errorf("release: %v", err)
+	}
+
+	if _, err := store.Claim(ctx, "stale", "third", time.Now().Add(time.Minute)); err != nil {
+		t.Errorf("claim after release: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+//go:build integration
+
+package integration
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"s3-analytics/internal/api/middleware"
+	"s3-analytics/internal/processor"
+	"s3-analytics/internal/services"
+
+	"github.com/google/uuid"
+)
+
+// fileResponse is the body of GET /files/:id.
+type fileResponse struct {
+	Data services.FileMetadata `json:"data"`
+}
+
+func (e *env) getFile(id string) services.FileMetadata {
+	e.t.Helper()
+
+	response := e.do(http.MethodGet, "/files/"+id, nil, nil)
+
+	if response.Code != http.StatusOK {
+		e.t.Fatalf("GET /files/%s: status %d: %s", id, response.Code, response.Body)
+	}
+
+	var file fileResponse
+	decode(e.t, response, &file)
+
+	return file.Data
+}
+
+func TestUploadIsProcessed(t *testing.T) {
+	e := newEnv(t)
+
+	content := []byte("id,amount\n1,10\n2,20\n")
+	digest := sha256.Sum256(content)
+	sum := hex.EncodeToString(digest[:])
+
+	id := e.upload("orders.csv", content)
+
+	file := e.getFile(id)
+
+	if file.Filename != "orders.csv" || file.Size != int64(len(content)) {
+		t.Errorf("GET /files/%s = %+v, want orders.csv with %d bytes", id, file, len(content))
+	}
+
+	e.waitForState(id, services.StateDone)
+
+	file = e.getFile(id)
+
+	if file.Sha256 != sum {
+		t.Errorf("sha256 = %q, want %q", file.Sha256, sum)
+	}
+
+	if file.ProcessedKey != processor.ProcessedKey(id) {
+		t.Errorf("processedKey = %q, want %q", file.ProcessedKey, processor.ProcessedKey(id))
+	}
+
+	if file.TraceID == "" {
+		t.Error("traceId is empty")
+	}
+
+	response := e.do(http.MethodGet, "/files/"+id+"/content", nil, nil)
+
+	if response.Code != http.StatusOK || response.Body.String() != string(content) {
+		t.Errorf("GET /files/%s/content: status %d, body %q", id, response.Code, response.Body)
+	}
+
+	response = e.do(http.MethodGet, "/files/"+id+"/processed", nil, nil)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("GET /files/%s/processed: status %d: %s", id, response.Code, response.Body)
+	}
+
+	var output processor.Output
+	decode(t, response, &output)
+
+	if output.FileID != id || output.Sha256 != sum || output.SizeBytes != int64(len(content)) || output.TraceID != file.TraceID {
+		t.Errorf("processed output = %+v", output)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	e := newEnv(t)
+
+	ids := []string{
+		e.upload("first.txt", []byte("first")),
+		e.upload("second.txt", []byte("second")),
+		e.upload("third.txt", []byte("third")),
+	}
+
+	for _, id := range ids {
+		e.waitForState(id, services.StateDone)
+	}
+
+	var seen []string
+	cursor := ""
+
+	// Pages of two walk every state partition of the index.
+	for {
+		query := url.Values{"limit": {"2"}, "order": {"asc"}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+
+		response := e.do(http.MethodGet, "/files?"+query.Encode(), nil, nil)
+
+		if response.Code != http.StatusOK {
+			t.Fatalf("GET /files: status %d: %s", response.Code, response.Body)
+		}
+
+		var page struct {
+			Data       []services.FileMetadata `json:"data"`
+			NextCursor string                  `json:"nextCursor"`
+		}
+		decode(t, response, &page)
+
+		for _, file := range page.Data {
+			seen = append(seen, file.ID)
+		}
+
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if len(seen) != len(ids) {
+		t.Fatalf("GET /files listed %v, want %v", seen, ids)
+	}
+
+	for i := range ids {
+		if seen[i] != ids[i] {
+			t.Errorf("GET /files listed %v, want %v in upload order", seen, ids)
+			break
+		}
+	}
+
+	response := e.do(http.MethodGet, "/files?state="+string(services.StateUploaded), nil, nil)
+
+	var uploaded struct {
+		Data []services.FileMetadata `json:"data"`
+	}
+	decode(t, response, &uploaded)
+
+	if len(uploaded.Data) != 0 {
+		t.Errorf("GET /files?state=uploaded listed %d processed files", len(uploaded.Data))
+	}
+}
+
+func TestDuplicateContentReusesProcessedOutput(t *testing.T) {
+	e := newEnv(t)
+
+	content := []byte("the same bytes twice")
+
+	first := e.upload("a.txt", content)
+	e.waitForState(first, services.StateDone)
+
+	second := e.upload("b.txt", content)
+	e.waitForState(second, services.StateDone)
+
+	if got := e.getFile(second).ProcessedKey; got != processor.ProcessedKey(first) {
+		t.Errorf("duplicate processedKey = %q, want the first upload's %q", got, processor.ProcessedKey(first))
+	}
+}
+
+func TestUnknownFile(t *testing.T) {
+	e := newEnv(t)
+
+	id := uuid.NewString()
+
+	for _, target := range []string{"/files/" + id, "/files/" + id + "/status", "/files/" + id + "/content"} {
+		if response := e.do(http.MethodGet, target, nil, nil); response.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", target, response.Code)
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	e := newEnv(t)
+
+	if response := e.do(http.MethodGet, "/readyz", nil, nil); response.Code != http.StatusOK {
+		t.Errorf("GET /readyz: status %d: %s", response.Code, response.Body)
+	}
+}
+
+func TestRequestIDIsEchoedAlongsideTraceparent(t *testing.T) {
+	e := newEnv(t)
+
+	response := e.do(http.MethodGet, "/readyz", nil, http.Header{
+		"Traceparent":  {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		"X-Request-Id": {"client-request-1"},
+	})
+
+	if got := response.Header().Get(middleware.RequestIDHeader); got != "client-request-1" {
+		t.Errorf("X-Request-ID = %q, want the client's own", got)
+	}
+
+	if got := response.Header().Get(middleware.TraceHeader); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("X-Trace-Id = %q, want the traceparent trace-id", got)
+	}
+}
+
+func TestDirectUploadCompletionCanBeRetried(t *testing.T) {
+	e := newEnv(t)
+
+	response := e.do(http.MethodPost, "/files/uploads", strings.NewReader(`{"filename": "retried.txt", "size": 5, "multipart": true}`), http.Header{"Content-Type": {"application/json"}})
+
+	if response.Code != http.StatusCreated {
+		t.Fatalf("POST /files/uploads: status %d: %s", response.Code, response.Body)
+	}
+
+	var created struct {
+		ID       string `json:"id"`
+		Key      string `json:"key"`
+		UploadID string `json:"uploadId"`
+	}
+	decode(t, response, &created)
+
+	multipartStore := e.storage.(services.MultipartStore)
+	etag, err := multipartStore.UploadPart(t.Context(), created.Key, created.UploadID, 1, strings.NewReader("hello"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := []services.CompletedPart{{PartNumber: 1, ETag: etag}}
+
+	// An earlier completion finished the multipart upload, then failed
+	// before updating the record.
+	if err := multipartStore.CompleteMultipartUpload(t.Context(), created.Key, created.UploadID, parts); err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(map[string]any{"parts": parts})
+	response = e.do(http.MethodPost, "/files/uploads/"+created.ID+"/complete", bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("retried POST /files/uploads/%s/complete: status %d: %s", created.ID, response.Code, response.Body)
+	}
+
+	e.waitForState(created.ID, services.StateDone)
+}
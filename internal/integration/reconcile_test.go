@@ -0,0 +1,189 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"s3-analytics/internal/lifecycle"
+	"s3-analytics/internal/processor"
+	"s3-analytics/internal/services"
+
+	"github.com/google/uuid"
+)
+
+// reconciler returns a Reconciler for the env that treats anything older
+// than a moment as stuck or abandoned.
+func (e *env) reconciler() *lifecycle.Reconciler {
+	reconciler := lifecycle.NewReconciler(e.storage, e.metadata, processor.NewProcessor(e.storage, e.metadata))
+	reconciler.StuckAfter = 10 * time.Millisecond
+	reconciler.AbandonAfter = 10 * time.Millisecond
+
+	return reconciler
+}
+
+// putObject stores content under key without a record.
+func (e *env) putObject(key, content string) {
+	e.t.Helper()
+
+	if err := e.storage.PutObject(context.Background(), key, strings.NewReader(content), nil); err != nil {
+		e.t.Fatalf("failed to put %s: %v", key, err)
+	}
+}
+
+// createRecord stores a record created an hour ago.
+func (e *env) createRecord(filename string, state services.State) string {
+	e.t.Helper()
+
+	id := uuid.NewString()
+	err := e.metadata.CreateItem(context.Background(), &services.FileMetadata{
+		ID:              id,
+		Filename:        filename,
+		ProcessingState: state,
+		CreatedAt:       time.Now().Add(-time.Hour).UTC(),
+	})
+
+	if err != nil {
+		e.t.Fatalf("failed to create record %s: %v", id, err)
+	}
+	return id
+}
+
+func TestReconcileReportsAndRepairs(t *testing.T) {
+	e := newEnv(t)
+	ctx := context.Background()
+
+	healthy := e.upload("healthy.txt", []byte("healthy"))
+	e.waitForState(healthy, services.StateDone)
+
+	orphanObject := services.RawKey(uuid.NewString(), "orphan.txt")
+	e.putObject(orphanObject, "no record")
+
+	orphanOutput := processor.ProcessedKey(uuid.NewString())
+	e.putObject(orphanOutput, "{}")
+
+	stuck := e.createRecord("stuck.txt", services.StateUploaded)
+	e.putObject(services.RawKey(stuck, "stuck.txt"), "never processed")
+
+	missing := e.createRecord("missing.txt", services.StateUploaded)
+	abandoned := e.createRecord("abandoned.txt", services.StatePendingUpload)
+
+	// Resumable uploads that have received bytes, or are being written to,
+	// are not abandoned however old they are.
+	resumable := e.createRecord("resumable.txt", services.StatePendingUpload)
+	offset := int64(3)
+
+	if err := e.metadata.UpdateItem(ctx, resumable, services.FileUpdate{UploadOffset: &offset}); err != nil {
+		t.Fatal(err)
+	}
+
+	active := e.createRecord("active.txt", services.StatePendingUpload)
+	leaseUntil := time.Now().Add(time.Minute).UTC()
+
+	if err := e.metadata.UpdateItem(ctx, active, services.FileUpdate{UploadLeaseUntil: &leaseUntil}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Let the objects age past StuckAfter.
+	time.Sleep(1100 * time.Millisecond)
+
+	reconciler := e.reconciler()
+	report, err := reconciler.ReconcileOnce(ctx)
+
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	assertEntries(t, "orphaned objects", report.OrphanObjects, orphanObject)
+	assertEntries(t, "orphaned outputs", report.OrphanOutputs, orphanOutput)
+	assertEntries(t, "stuck records", report.StuckRecords, stuck)
+	assertEntries(t, "records without content", report.MissingObjects, missing)
+	assertEntries(t, "abandoned uploads", report.AbandonedUploads, abandoned)
+
+	if report.Repaired != 0 {
+		t.Fatalf("report-only run repaired %d problems", report.Repaired)
+	}
+
+	reconciler.Repair = true
+
+	if report, err = reconciler.ReconcileOnce(ctx); err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+
+	if report.Repaired != 5 || report.RepairFailures != 0 {
+		t.Fatalf("repaired %d problems with %d failures, want 5 and 0", report.Repaired, report.RepairFailures)
+	}
+
+	for _, key := range []string{orphanObject, orphanOutput} {
+		if _, err := e.storage.HeadObject(ctx, key); !errors.Is(err, services.ErrNotFound) {
+			t.Errorf("%s: got %v after repair, want ErrNotFound", key, err)
+		}
+	}
+
+	for _, id := range []string{missing, abandoned} {
+		if _, err := e.metadata.GetFileById(ctx, id); !errors.Is(err, services.ErrNotFound) {
+			t.Errorf("record %s: got %v after repair, want ErrNotFound", id, err)
+		}
+	}
+
+	for _, id := range []string{resumable, active} {
+		if _, err := e.metadata.GetFileById(ctx, id); err != nil {
+			t.Errorf("record %s: got %v after repair, want it kept", id, err)
+		}
+	}
+
+	e.waitForState(stuck, services.StateDone)
+	e.waitForState(healthy, services.StateDone)
+
+	if report, err = reconciler.ReconcileOnce(ctx); err != nil || report.Problems() != 0 {
+		t.Fatalf("after repair: %d problems, error %v", report.Problems(), err)
+	}
+}
+
+func TestReconcileBackfillsOrphanedObjects(t *testing.T) {
+	e := newEnv(t)
+
+	id := uuid.NewString()
+	e.putObject(services.RawKey(id, "backfilled.txt"), "recovered")
+
+	time.Sleep(1100 * time.Millisecond)
+
+	reconciler := e.reconciler()
+	reconciler.Repair = true
+	reconciler.Backfill = true
+
+	report, err := reconciler.ReconcileOnce(context.Background())
+
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	if report.Repaired != 1 {
+		t.Fatalf("repaired %d problems, want 1", report.Repaired)
+	}
+
+	e.waitForState(id, services.StateDone)
+
+	file, err := e.metadata.GetFileById(context.Background(), id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if file.Filename != "backfilled.txt" || file.Size != int64(len("recovered")) {
+		t.Fatalf("backfilled record has filename %q and size %d", file.Filename, file.Size)
+	}
+}
+
+func assertEntries(t *testing.T, name string, got []string, want ...string) {
+	t.Helper()
+
+	if !slices.Equal(got, want) {
+		t.Errorf("%s: got %q, want %q", name, got, want)
+	}
+}
@@ -0,0 +1,154 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"s3-analytics/internal/processor"
+	"s3-analytics/internal/services"
+
+	"github.com/google/uuid"
+)
+
+// fileStatus is the body of GET /files/:id/status.
+type fileStatus struct {
+	Status         services.State               `json:"status"`
+	Attempts       int                          `json:"attempts"`
+	LastError      string                       `json:"lastError"`
+	StateChangedAt map[services.State]time.Time `json:"stateChangedAt"`
+}
+
+func (e *env) status(id string) fileStatus {
+	e.t.Helper()
+
+	response := e.do(http.MethodGet, "/files/"+id+"/status", nil, nil)
+
+	if response.Code != http.StatusOK {
+		e.t.Fatalf("GET /files/%s/status: status %d: %s", id, response.Code, response.Body)
+	}
+
+	var status fileStatus
+	decode(e.t, response, &status)
+	return status
+}
+
+func TestStatusReportsStateHistory(t *testing.T) {
+	e := newEnv(t)
+
+	id := e.upload("history.txt", []byte("history"))
+	e.waitForState(id, services.StateDone)
+
+	status := e.status(id)
+
+	if status.Attempts != 1 || status.LastError != "" {
+		t.Errorf("attempts %d, lastError %q, want 1 and none", status.Attempts, status.LastError)
+	}
+
+	for _, state := range []services.State{services.StateUploaded, services.StateProcessing, services.StateDone} {
+		if status.StateChangedAt[state].IsZero() {
+			t.Errorf("stateChangedAt has no %s time: %v", state, status.StateChangedAt)
+		}
+	}
+
+	if response := e.do(http.MethodDelete, "/files/"+id, nil, nil); response.Code != http.StatusOK {
+		t.Fatalf("DELETE /files/%s: status %d: %s", id, response.Code, response.Body)
+	}
+
+	for _, target := range []string{"/files/" + id, "/files/" + id + "/status"} {
+		if response := e.do(http.MethodGet, target, nil, nil); response.Code != http.StatusNotFound {
+			t.Errorf("GET %s after delete: status %d, want 404", target, response.Code)
+		}
+	}
+
+	response := e.do(http.MethodGet, "/files/"+id+"/status?includeDeleted=true", nil, nil)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("GET /files/%s/status?includeDeleted=true: status %d: %s", id, response.Code, response.Body)
+	}
+
+	var deleted fileStatus
+	decode(t, response, &deleted)
+
+	if deleted.Status != services.StateDeleted || deleted.StateChangedAt[services.StateDeleted].IsZero() {
+		t.Errorf("after delete: %+v", deleted)
+	}
+
+	if response := e.do(http.MethodDelete, "/files/"+id, nil, nil); response.Code != http.StatusNotFound {
+		t.Errorf("second DELETE /files/%s: status %d, want 404", id, response.Code)
+	}
+
+	if response := e.do(http.MethodPost, "/files/"+id+"/restore", nil, nil); response.Code != http.StatusOK {
+		t.Fatalf("POST /files/%s/restore: status %d: %s", id, response.Code, response.Body)
+	}
+
+	if restored := e.status(id); restored.Status != services.StateDone || !restored.StateChangedAt[services.StateDone].Equal(status.StateChangedAt[services.StateDone]) {
+		t.Errorf("after restore: %+v, want done as of %v", restored, status.StateChangedAt[services.StateDone])
+	}
+
+	if response := e.do(http.MethodPost, "/files/"+id+"/restore", nil, nil); response.Code != http.StatusConflict {
+		t.Errorf("second POST /files/%s/restore: status %d, want 409", id, response.Code)
+	}
+}
+
+func TestProcessorRetriesFailedAndQuarantinesMismatchedContent(t *testing.T) {
+	e := newEnv(t)
+	ctx := context.Background()
+	p := processor.NewProcessor(e.storage, e.metadata)
+
+	create := func(filename string, file services.FileMetadata) string {
+		file.ID = uuid.NewString()
+		file.Filename = filename
+		file.CreatedAt = time.Now().UTC()
+
+		if err := e.metadata.CreateItem(ctx, &file); err != nil {
+			t.Fatalf("failed to create record %s: %v", file.ID, err)
+		}
+
+		e.putObject(services.RawKey(file.ID, filename), filename)
+		return file.ID
+	}
+
+	retried := create("retried.txt", services.FileMetadata{ProcessingState: services.StateFailed, Attempts: 1, LastError: "earlier failure"})
+	exhausted := create("exhausted.txt", services.FileMetadata{ProcessingState: services.StateFailed, Attempts: p.MaxAttempts})
+	mismatched := create("mismatched.txt", services.FileMetadata{ProcessingState: services.StateUploaded, Sha256: "0000"})
+
+	for _, id := range []string{retried, exhausted, mismatched} {
+		if err := p.Process(ctx, services.RawKey(id, e.getFile(id).Filename)); err != nil {
+			t.Fatalf("process %s: %v", id, err)
+		}
+	}
+
+	if status := e.status(retried); status.Status != services.StateDone || status.Attempts != 2 {
+		t.Errorf("retried file: %+v, want done after 2 attempts", status)
+	}
+
+	if status := e.status(exhausted); status.Status != services.StateFailed || status.Attempts != p.MaxAttempts {
+		t.Errorf("exhausted file: %+v, want failed and not attempted again", status)
+	}
+
+	if status := e.status(mismatched); status.Status != services.StateQuarantined || status.LastError == "" {
+		t.Errorf("mismatched file: %+v, want quarantined with a lastError", status)
+	}
+
+	if response := e.do(http.MethodGet, "/files/"+mismatched+"/content", nil, nil); response.Code != http.StatusConflict {
+		t.Errorf("GET /files/%s/content: status %d, want 409", mismatched, response.Code)
+	}
+}
+
+func TestFileBeingProcessedCannotBeDeleted(t *testing.T) {
+	e := newEnv(t)
+
+	id := e.createRecord("busy.txt", services.StateProcessing)
+
+	if response := e.do(http.MethodDelete, "/files/"+id, nil, nil); response.Code != http.StatusConflict {
+		t.Fatalf("DELETE /files/%s while processing: status %d, want 409", id, response.Code)
+	}
+
+	if status := e.status(id); status.Status != services.StateProcessing {
+		t.Errorf("file is %q after a refused delete, want processing", status.Status)
+	}
+}
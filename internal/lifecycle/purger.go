@@ -0,0 +1,184 @@
+// Package lifecycle keeps stored files tidy in the background: it removes
+// soft-deleted files for good once their grace period has passed, and
+// reconciles the bucket with the metadata table.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"s3-analytics/internal/logging"
+	"s3-analytics/internal/services"
+	"time"
+)
+
+// Purger hard-deletes soft-deleted files: the raw and processed objects when
+// no other record shares them, and the metadata record.
+type Purger struct {
+	Storage     services.BlobStore
+	Metadata    services.MetadataStore
+	GracePeriod time.Duration
+	log         *slog.Logger
+}
+
+func NewPurger(storage services.BlobStore, metadata services.MetadataStore, gracePeriod time.Duration) *Purger {
+	return &Purger{
+		Storage:     storage,
+		Metadata:    metadata,
+		GracePeriod: gracePeriod,
+		log:         logging.NewStructuredLogger().With("component", "purger"),
+	}
+}
+
+// Run purges every interval until ctx is cancelled.
+func (p *Purger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := p.PurgeOnce(ctx)
+
+			if err != nil {
+				p.log.Error("Purge failed.", "purged", purged, "error", err)
+				continue
+			}
+
+			if purged > 0 {
+				p.log.Info("Purged deleted files.", "purged", purged)
+			}
+		}
+	}
+}
+
+// PurgeOnce removes every file deleted more than GracePeriod ago and returns
+// how many were removed. Files that fail are left for the next run.
+func (p *Purger) PurgeOnce(ctx context.Context) (int, error) {
+	items, err := p.Metadata.GetAllItems(ctx)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	cutoff := time.Now().Add(-p.GracePeriod)
+	purged := 0
+	var errs []error
+
+	for _, item := range items {
+		if !item.Deleted() || item.DeletedAt.After(cutoff) {
+			continue
+		}
+
+		ok, err := p.purge(ctx, item.ID)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("file %s: %w", item.ID, err))
+			continue
+		}
+
+		if ok {
+			purged++
+		}
+	}
+
+	return purged, errors.Join(errs...)
+}
+
+// purge removes one file. It reports false when the file was restored or
+// removed since it was listed.
+func (p *Purger) purge(ctx context.Context, id string) (bool, error) {
+	// Re-read the record so a restore since the listing wins.
+	file, err := p.Metadata.GetFileById(ctx, id)
+
+	if errors.Is(err, services.ErrNotFound) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if !file.Deleted() {
+		return false, nil
+	}
+
+	key := file.RawObjectKey()
+
+	if err := abortUpload(ctx, p.Storage, file, p.log); err != nil {
+		return false, err
+	}
+
+	rawShared, processedShared, err := p.sharedKeys(ctx, file)
+
+	if err != nil {
+		return false, err
+	}
+
+	if !rawShared {
+		if err := p.Storage.DeleteObject(ctx, key); err != nil {
+			return false, err
+		}
+	}
+
+	if file.ProcessedKey != "" && !processedShared {
+		if err := p.Storage.DeleteObject(ctx, file.ProcessedKey); err != nil {
+			return false, err
+		}
+	}
+
+	if err := p.Metadata.DeleteItem(ctx, file.ID); err != nil {
+		return false, err
+	}
+
+	p.log.Info("File purged.", "file_id", file.ID, "key", key, "processed_key", file.ProcessedKey)
+
+	return true, nil
+}
+
+// abortUpload discards what an unfinished multipart or resumable upload of
+// file has stored so far.
+func abortUpload(ctx context.Context, storage services.BlobStore, file services.FileMetadata, log *slog.Logger) error {
+	if file.UploadID == "" {
+		return nil
+	}
+
+	if multipartStore, ok := storage.(services.MultipartStore); ok {
+		// The upload may already be gone; that must not block the caller.
+		if err := multipartStore.AbortMultipartUpload(ctx, file.RawObjectKey(), file.UploadID); err != nil {
+			log.Warn("Abort multipart upload failed.", "file_id", file.ID, "error", err)
+		}
+	}
+
+	return services.DeleteResumableTails(ctx, storage, file.ID, file.UploadOffset)
+}
+
+// sharedKeys reports whether another record with the same content still
+// uses the file's raw object or its processed object: uploads deduplicated
+// by the processor share the processed object, those deduplicated by their
+// declared sha256 share both.
+func (p *Purger) sharedKeys(ctx context.Context, file services.FileMetadata) (raw, processed bool, err error) {
+	if file.Sha256 == "" {
+		return false, false, nil
+	}
+
+	items, err := p.Metadata.FindBySha256(ctx, file.Sha256)
+
+	if err != nil {
+		return false, false, err
+	}
+
+	for _, item := range items {
+		if item.ID == file.ID {
+			continue
+		}
+
+		raw = raw || item.RawObjectKey() == file.RawObjectKey()
+		processed = processed || (file.ProcessedKey != "" && item.ProcessedKey == file.ProcessedKey)
+	}
+
+	return raw, processed, nil
+}
@@ -0,0 +1,483 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"path"
+	"s3-analytics/internal/logging"
+	"s3-analytics/internal/processor"
+	"s3-analytics/internal/services"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultStuckAfter is how long processing may take before a record is
+	// reported as stuck.
+	DefaultStuckAfter = time.Hour
+	// DefaultAbandonAfter is how long a pending upload may go without
+	// storing anything or being written to before it is reported as
+	// abandoned.
+	DefaultAbandonAfter = 24 * time.Hour
+)
+
+// Reconciler compares the bucket with the metadata table and reports what
+// failed uploads and processing runs left behind:
+//
+//   - raw/ and processed/ objects no record points to;
+//   - records whose raw object is gone;
+//   - records whose content has not been processed within StuckAfter,
+//     including failed ones with attempts left;
+//   - pending uploads that have stored nothing, not even part of a
+//     resumable upload, and seen no activity within AbandonAfter.
+//
+// With Repair set it also fixes them: orphaned objects are deleted, or with
+// Backfill given a record and processed; stuck records are processed again,
+// after being failed first if they were left in processing; records without
+// content and abandoned uploads are deleted. The processed output of a
+// deleted record is left to the next run, which finds it orphaned.
+type Reconciler struct {
+	Storage  services.BlobStore
+	Metadata services.MetadataStore
+	// Processor re-runs processing for stuck and backfilled records.
+	Processor *processor.Processor
+	// StuckAfter is also how old an object must be before it counts as
+	// orphaned; younger ones may belong to an upload still in flight.
+	StuckAfter   time.Duration
+	AbandonAfter time.Duration
+	Repair       bool
+	Backfill     bool
+	log          *slog.Logger
+}
+
+func NewReconciler(storage services.BlobStore, metadata services.MetadataStore, p *processor.Processor) *Reconciler {
+	return &Reconciler{
+		Storage:      storage,
+		Metadata:     metadata,
+		Processor:    p,
+		StuckAfter:   DefaultStuckAfter,
+		AbandonAfter: DefaultAbandonAfter,
+		log:          logging.NewStructuredLogger().With("component", "reconciler"),
+	}
+}
+
+// Report is the outcome of one reconciliation.
+type Report struct {
+	// Objects and Records count what was scanned.
+	Objects int
+	Records int
+	// OrphanObjects and OrphanOutputs are raw/ and processed/ keys no
+	// record points to.
+	OrphanObjects []string
+	OrphanOutputs []string
+	// MissingObjects, StuckRecords and AbandonedUploads are file ids.
+	MissingObjects   []string
+	StuckRecords     []string
+	AbandonedUploads []string
+	// Repaired counts the problems fixed, RepairFailures those that could
+	// not be; problems that went away on their own count as neither.
+	Repaired       int
+	RepairFailures int
+}
+
+// Problems returns the number of problems found.
+func (r *Report) Problems() int {
+	return len(r.OrphanObjects) + len(r.OrphanOutputs) + len(r.MissingObjects) + len(r.StuckRecords) + len(r.AbandonedUploads)
+}
+
+// WriteSummary writes the counts, and the keys and ids behind them, to w.
+func (r *Report) WriteSummary(w io.Writer) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Scanned %d objects and %d records.\n", r.Objects, r.Records)
+
+	sections := []struct {
+		title   string
+		entries []string
+	}{
+		{"Orphaned objects", r.OrphanObjects},
+		{"Orphaned outputs", r.OrphanOutputs},
+		{"Records without content", r.MissingObjects},
+		{"Stuck records", r.StuckRecords},
+		{"Abandoned uploads", r.AbandonedUploads},
+	}
+
+	for _, section := range sections {
+		fmt.Fprintf(&b, "%-25s %d\n", section.title+":", len(section.entries))
+
+		for _, entry := range section.entries {
+			fmt.Fprintf(&b, "  %s\n", entry)
+		}
+	}
+
+	fmt.Fprintf(&b, "%-25s %d\n", "Repaired:", r.Repaired)
+	fmt.Fprintf(&b, "%-25s %d\n", "Repair failures:", r.RepairFailures)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Run reconciles every interval until ctx is cancelled.
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := r.ReconcileOnce(ctx)
+
+			if err != nil {
+				r.log.Error("Reconciliation failed.", "error", err)
+				continue
+			}
+
+			if report.Problems() > 0 {
+				r.log.Warn("Reconciliation found problems.", report.attrs()...)
+			}
+		}
+	}
+}
+
+// ReconcileOnce scans the bucket and the table once. Problems are
+// re-checked before they are reported, so races with uploads, purges and
+// processing in progress do not show up. A failed repair is reported in
+// the returned error alongside the report.
+func (r *Reconciler) ReconcileOnce(ctx context.Context) (*Report, error) {
+	lister, ok := r.Storage.(services.ObjectLister)
+
+	if !ok {
+		return nil, errors.New("storage backend cannot list objects")
+	}
+
+	now := time.Now()
+	objects := map[string]services.ObjectInfo{}
+
+	// Objects are listed before the table is scanned: a record is written
+	// before its object, so every object listed has its record in the scan.
+	for _, prefix := range []string{"raw/", "processed/"} {
+		err := lister.ListObjects(ctx, prefix, func(info services.ObjectInfo) error {
+			objects[info.Key] = info
+			return nil
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+	}
+
+	items, err := r.Metadata.GetAllItems(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	report := &Report{Objects: len(objects), Records: len(items)}
+	var errs []error
+
+	repair := func(problem string, ok bool, err error) {
+		if err != nil {
+			report.RepairFailures++
+			errs = append(errs, fmt.Errorf("%s: %w", problem, err))
+		} else if ok {
+			report.Repaired++
+		}
+	}
+
+	stuckCutoff := now.Add(-r.StuckAfter)
+	abandonCutoff := now.Add(-r.AbandonAfter)
+	referenced := map[string]bool{}
+
+	for _, item := range items {
+		referenced[item.RawObjectKey()] = true
+		if item.ProcessedKey != "" {
+			referenced[item.ProcessedKey] = true
+		}
+
+		// Deleted files are the purger's.
+		if item.Deleted() {
+			continue
+		}
+
+		_, stored := objects[item.RawObjectKey()]
+
+		switch {
+		case item.ProcessingState == services.StatePendingUpload && !stored:
+			if abandoned(item, abandonCutoff) && r.confirm(ctx, item, false) {
+				r.log.Warn("Abandoned upload.", "file_id", item.ID, "last_activity", lastActivity(item))
+				report.AbandonedUploads = append(report.AbandonedUploads, item.ID)
+
+				if r.Repair {
+					ok, err := r.deleteRecord(ctx, item.ID, services.StatePendingUpload)
+					repair("abandoned upload "+item.ID, ok, err)
+				}
+			}
+		case !stored:
+			if item.CreatedAt.Before(stuckCutoff) && r.confirm(ctx, item, false) {
+				r.log.Warn("Record without content.", "file_id", item.ID, "key", item.RawObjectKey())
+				report.MissingObjects = append(report.MissingObjects, item.ID)
+
+				if r.Repair {
+					ok, err := r.deleteRecord(ctx, item.ID, item.ProcessingState)
+					repair("record without content "+item.ID, ok, err)
+				}
+			}
+		case r.awaitsProcessing(item):
+			since := stateSince(item)
+
+			if since.Before(stuckCutoff) && r.confirm(ctx, item, true) {
+				r.log.Warn("Stuck record.", "file_id", item.ID, "state", item.ProcessingState, "since", since)
+				report.StuckRecords = append(report.StuckRecords, item.ID)
+
+				if r.Repair {
+					err := r.retry(ctx, item)
+					repair("stuck record "+item.ID, err == nil, err)
+				}
+			}
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(objects)) {
+		info := objects[key]
+
+		if referenced[key] || !info.LastModified.Before(stuckCutoff) || !r.orphaned(ctx, key) {
+			continue
+		}
+
+		if strings.HasPrefix(key, "processed/") {
+			r.log.Warn("Orphaned output.", "key", key)
+			report.OrphanOutputs = append(report.OrphanOutputs, key)
+
+			if r.Repair {
+				err := r.Storage.DeleteObject(ctx, key)
+				repair("orphaned output "+key, err == nil, err)
+			}
+			continue
+		}
+
+		r.log.Warn("Orphaned object.", "key", key)
+		report.OrphanObjects = append(report.OrphanObjects, key)
+
+		if r.Repair {
+			if r.Backfill {
+				err := r.backfill(ctx, info)
+				repair("orphaned object "+key, err == nil, err)
+			} else {
+				err := r.Storage.DeleteObject(ctx, key)
+				repair("orphaned object "+key, err == nil, err)
+			}
+		}
+	}
+
+	r.emitMetrics(report)
+
+	return report, errors.Join(errs...)
+}
+
+// confirm re-reads a record found during the scan and reports whether it is
+// unchanged and its raw object still is, or is not, stored.
+func (r *Reconciler) confirm(ctx context.Context, listed services.FileMetadata, stored bool) bool {
+	file, err := r.Metadata.GetFileById(ctx, listed.ID)
+
+	if err != nil || file.Deleted() || file.ProcessingState != listed.ProcessingState {
+		return false
+	}
+
+	if file.UploadOffset != listed.UploadOffset || !lastActivity(file).Equal(lastActivity(listed)) {
+		return false
+	}
+
+	_, err = r.Storage.HeadObject(ctx, file.RawObjectKey())
+
+	if stored {
+		return err == nil
+	}
+	return errors.Is(err, services.ErrNotFound)
+}
+
+// orphaned reports whether key is still stored and, for a raw object, its
+// file still has no record.
+func (r *Reconciler) orphaned(ctx context.Context, key string) bool {
+	if _, err := r.Storage.HeadObject(ctx, key); err != nil {
+		return false
+	}
+
+	if id, err := processor.ParseFileID(key); err == nil && strings.HasPrefix(key, "raw/") {
+		_, err := r.Metadata.GetFileById(ctx, id)
+		return errors.Is(err, services.ErrNotFound)
+	}
+
+	return true
+}
+
+// abandoned reports whether file is a pending upload that has stored nothing
+// and has not been written to since cutoff. A resumable upload that has
+// received some bytes is never abandoned: its client can still resume it.
+func abandoned(file services.FileMetadata, cutoff time.Time) bool {
+	if file.UploadOffset > 0 || len(file.UploadParts) > 0 {
+		return false
+	}
+	return lastActivity(file).Before(cutoff)
+}
+
+// lastActivity is when an upload was last written to, as far as the record
+// tells: the end of its latest upload lease, which a PATCH takes and renews
+// before every write, or else its creation.
+func lastActivity(file services.FileMetadata) time.Time {
+	if file.UploadLeaseUntil != nil && file.UploadLeaseUntil.After(file.CreatedAt) {
+		return *file.UploadLeaseUntil
+	}
+	return file.CreatedAt
+}
+
+// awaitsProcessing reports whether file, whose content is stored, should
+// still reach done: it has not been processed, is being processed, or has
+// failed with attempts left.
+func (r *Reconciler) awaitsProcessing(file services.FileMetadata) bool {
+	switch file.ProcessingState {
+	case services.StatePendingUpload, services.StateUploaded, services.StateProcessing:
+		return true
+	case services.StateFailed:
+		return r.Processor != nil && r.Processor.Processable(file)
+	}
+	return false
+}
+
+// stateSince returns when file entered its current state.
+func stateSince(file services.FileMetadata) time.Time {
+	if at, ok := file.StateTimes()[file.ProcessingState]; ok {
+		return at
+	}
+	return file.CreatedAt
+}
+
+// retry processes a stuck file again. A file stuck in processing was left
+// there by a run that died; it is failed first so it can be claimed again.
+func (r *Reconciler) retry(ctx context.Context, file services.FileMetadata) error {
+	if file.ProcessingState == services.StateProcessing {
+		update := services.Transition(services.StateProcessing, services.StateFailed)
+		reason := fmt.Sprintf("processing did not finish within %s", r.StuckAfter)
+		update.LastError = &reason
+
+		err := r.Metadata.UpdateItem(ctx, file.ID, update)
+
+		// The run finished after all.
+		if errors.Is(err, services.ErrStateConflict) || errors.Is(err, services.ErrNotFound) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.process(ctx, file.RawObjectKey())
+}
+
+// deleteRecord removes a record along with any unfinished upload. It
+// reports false when the record changed since it was checked.
+func (r *Reconciler) deleteRecord(ctx context.Context, id string, state services.State) (bool, error) {
+	file, err := r.Metadata.GetFileById(ctx, id)
+
+	if errors.Is(err, services.ErrNotFound) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if file.Deleted() || file.ProcessingState != state {
+		return false, nil
+	}
+
+	if err := abortUpload(ctx, r.Storage, file, r.log); err != nil {
+		return false, err
+	}
+
+	if err := r.Metadata.DeleteItem(ctx, id); err != nil {
+		return false, err
+	}
+
+	r.log.Info("Record deleted.", "file_id", id, "state", state)
+
+	return true, nil
+}
+
+// backfill gives an orphaned raw object a record and processes it.
+func (r *Reconciler) backfill(ctx context.Context, info services.ObjectInfo) error {
+	id, err := processor.ParseFileID(info.Key)
+
+	if err != nil {
+		return err
+	}
+
+	metadata := &services.FileMetadata{
+		ID:              id,
+		Filename:        strings.TrimPrefix(path.Base(info.Key), id+"-"),
+		Size:            info.Size,
+		ProcessingState: services.StateUploaded,
+		CreatedAt:       info.LastModified,
+	}
+
+	if err := r.Metadata.CreateItem(ctx, metadata); err != nil {
+		return fmt.Errorf("failed to create record: %w", err)
+	}
+
+	r.log.Info("Record backfilled.", "file_id", id, "key", info.Key)
+
+	return r.process(ctx, info.Key)
+}
+
+func (r *Reconciler) process(ctx context.Context, key string) error {
+	if r.Processor == nil {
+		return errors.New("no processor to run")
+	}
+	return r.Processor.Process(ctx, key)
+}
+
+// attrs lists the report's counts as log attributes.
+func (r *Report) attrs() []any {
+	return []any{
+		"objects", r.Objects,
+		"records", r.Records,
+		"orphan_objects", len(r.OrphanObjects),
+		"orphan_outputs", len(r.OrphanOutputs),
+		"missing_objects", len(r.MissingObjects),
+		"stuck_records", len(r.StuckRecords),
+		"abandoned_uploads", len(r.AbandonedUploads),
+		"repaired", r.Repaired,
+		"repair_failures", r.RepairFailures,
+	}
+}
+
+// emitMetrics writes the report as one CloudWatch Embedded Metric Format
+// line, so alarms can watch for orphans and stuck records.
+func (r *Reconciler) emitMetrics(report *Report) {
+	count := func(name string, value int) logging.Metric {
+		return logging.Metric{Name: name, Unit: "Count", Value: float64(value)}
+	}
+
+	logging.EmitMetrics(r.log, logging.MetricSet{
+		Namespace:  "FilePipeline/Reconciler",
+		Dimensions: map[string]string{"ReconcilerName": "reconciler"},
+		Metrics: []logging.Metric{
+			count("ObjectsScanned", report.Objects),
+			count("RecordsScanned", report.Records),
+			count("OrphanObjects", len(report.OrphanObjects)),
+			count("OrphanOutputs", len(report.OrphanOutputs)),
+			count("MissingObjects", len(report.MissingObjects)),
+			count("StuckRecords", len(report.StuckRecords)),
+			count("AbandonedUploads", len(report.AbandonedUploads)),
+			count("Repaired", report.Repaired),
+			count("RepairFailures", report.RepairFailures),
+		},
+	})
+}
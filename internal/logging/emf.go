@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Metric is one value in an Embedded Metric Format line.
+type Metric struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// MetricSet is one EMF metric directive: metrics that share a namespace and
+// a set of dimensions.
+type MetricSet struct {
+	Namespace  string
+	Dimensions map[string]string
+	Metrics    []Metric
+}
+
+// EmitMetrics writes sets as a single CloudWatch Embedded Metric Format log
+// line. CloudWatch Logs extracts the metrics without any PutMetricData call.
+// Metric and dimension names share the line's top level, so the sets must
+// not give one name two different values.
+func EmitMetrics(log *slog.Logger, sets ...MetricSet) {
+	directives := make([]map[string]any, 0, len(sets))
+	attrs := []any{}
+	seen := map[string]bool{}
+
+	for _, set := range sets {
+		names := make([]string, 0, len(set.Dimensions))
+		for name, value := range set.Dimensions {
+			names = append(names, name)
+
+			if !seen[name] {
+				seen[name] = true
+				attrs = append(attrs, name, value)
+			}
+		}
+		slices.Sort(names)
+
+		metrics := make([]map[string]string, 0, len(set.Metrics))
+		for _, m := range set.Metrics {
+			metrics = append(metrics, map[string]string{"Name": m.Name, "Unit": m.Unit})
+			attrs = append(attrs, m.Name, m.Value)
+		}
+
+		directives = append(directives, map[string]any{
+			"Namespace":  set.Namespace,
+			"Dimensions": [][]string{names},
+			"Metrics":    metrics,
+		})
+	}
+
+	attrs = append(attrs, "_aws", map[string]any{
+		"Timestamp":         time.Now().UnixMilli(),
+		"CloudWatchMetrics": directives,
+	})
+
+	log.Info("metric", attrs...)
+}
@@ -5,6 +5,15 @@ import (
 	"os"
 )
 
+// level is shared by every StructuredLogger so SetLevel applies to loggers
+// created before it is called.
+var level = new(slog.LevelVar)
+
+// SetLevel sets the minimum level of every StructuredLogger.
+func SetLevel(l slog.Level) {
+	level.Set(l)
+}
+
 type StructuredLogger struct {
 	base *slog.Logger
 }
@@ -12,11 +21,14 @@ type StructuredLogger struct {
 func NewStructuredLogger() *StructuredLogger {
 	return &StructuredLogger{
 		base: slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-			Level: slog.LevelInfo,
+			Level: level,
 		})),
 	}
 }
 
-func  (sl *StructuredLogger) WithTrace(traceID, component, method, endpoint string) *slog.Logger {
+func (sl *StructuredLogger) WithTrace(traceID, component, method, endpoint string) *slog.Logger {
 	return sl.base.With("trace_id", traceID, "component", component, "method", method, "endpoint", endpoint)
-}
\ No newline at end of file
+}
+func (sl *StructuredLogger) With(args ...any) *slog.Logger {
+	return sl.base.With(args...)
+}
@@ -0,0 +1,14 @@
+package processor
+
+import "s3-analytics/internal/logging"
+
+// emitMetric writes a CloudWatch Embedded Metric Format line through the
+// processor's logger, which Lambda forwards to CloudWatch Logs without any
+// PutMetricData call.
+func (p *Processor) emitMetric(name string, value float64, unit string) {
+	logging.EmitMetrics(p.Logger.With("component", "processor"), logging.MetricSet{
+		Namespace:  "FilePipeline/Processor",
+		Dimensions: map[string]string{"ProcessorName": "processor"},
+		Metrics:    []logging.Metric{{Name: name, Unit: unit, Value: value}},
+	})
+}
@@ -0,0 +1,419 @@
+// Package processor is the asynchronous processing stage of the pipeline.
+//
+// For every object created under raw/<uuid>-<filename> it:
+//  1. Reads the object's trace_id from its metadata.
+//  2. Claims the FileMetadata record by moving it to "processing", which
+//     counts an attempt.
+//  3. Streams the content to compute size, MIME type and sha256. Content
+//     that does not match the size or sha256 recorded at upload, or that
+//     exceeds MaxUploadSize, is quarantined.
+//  4. Looks the sha256 up on the Sha256Index; a hit reuses the existing
+//     processed output instead of writing a new one.
+//  5. Otherwise writes a JSON summary to processed/<uuid>.json.
+//  6. Marks the record "done" with its processedKey, sha256 and the
+//     trace_id, so one ID links the upload request to the output.
+//
+// A step that fails marks the record "failed" with the error; a later event
+// or reconciliation retries it until MaxAttempts is reached. Records in any
+// other state, such as done after a duplicate event, are left alone.
+//
+// Objects whose record does not exist belong to uploads the API is
+// discarding; they are skipped, and any output already written is removed.
+//
+// It runs as a Lambda behind the S3 EventBridge rule (cmd/processor) and as
+// an in-process Worker inside cmd/api for the local and memory backends.
+package processor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"s3-analytics/internal/logging"
+	"s3-analytics/internal/services"
+	"s3-analytics/internal/telemetry"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrNoFileID is returned for keys that do not start with a file id.
+var ErrNoFileID = errors.New("object key does not contain a file id")
+
+var fileIDPattern = regexp.MustCompile(`^([0-9a-fA-F-]{36})-`)
+
+// Output is the JSON summary written to processed/<uuid>.json.
+type Output struct {
+	FileID      string `json:"file_id"`
+	RawFilename string `json:"raw_filename"`
+	SizeBytes   int64  `json:"size_bytes"`
+	MimeType    string `json:"mime_type"`
+	Sha256      string `json:"sha256"`
+	Status      string `json:"status"`
+	TraceID     string `json:"trace_id,omitempty"`
+}
+
+// DefaultMaxAttempts is how many times a file is processed before it is
+// left failed.
+const DefaultMaxAttempts = 3
+
+type Processor struct {
+	Storage  services.BlobStore
+	Metadata services.MetadataStore
+	Logger   *logging.StructuredLogger
+	// MaxAttempts bounds the attempts to process one file, retries of
+	// failed ones included.
+	MaxAttempts int
+	// MaxUploadSize, when positive, is the largest object processed. It
+	// matches the API's limit, which a presigned PUT can get past.
+	MaxUploadSize int64
+}
+
+func NewProcessor(storage services.BlobStore, metadata services.MetadataStore) *Processor {
+	return &Processor{
+		Storage:     storage,
+		Metadata:    metadata,
+		Logger:      logging.NewStructuredLogger(),
+		MaxAttempts: DefaultMaxAttempts,
+	}
+}
+
+// ProcessedKey returns the key the summary for id is written to.
+func ProcessedKey(id string) string {
+	return fmt.Sprintf("processed/%s.json", id)
+}
+
+// ParseFileID extracts the file id from a raw/<uuid>-<filename> key.
+func ParseFileID(key string) (string, error) {
+	match := fileIDPattern.FindStringSubmatch(path.Base(key))
+
+	if match == nil {
+		return "", fmt.Errorf("%w: %s", ErrNoFileID, key)
+	}
+
+	return match[1], nil
+}
+
+// Process runs the pipeline for one raw object. Its span continues the
+// trace of the upload request when the object carries one.
+func (p *Processor) Process(ctx context.Context, key string) (err error) {
+	start := time.Now()
+
+	head, err := p.Storage.HeadObject(ctx, key)
+
+	if err != nil {
+		p.emitMetric("FileDownloadFailures", 1, "Count")
+		return fmt.Errorf("failed to head %s: %w", key, err)
+	}
+
+	ctx, span := telemetry.Tracer.Start(telemetry.Extract(ctx, head.Metadata), "processor.Process",
+		trace.WithAttributes(attribute.String("s3.key", key)))
+
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	traceID := head.Metadata["trace_id"]
+	log := p.Logger.With("trace_id", traceID, "component", "processor", "key", key)
+	log.Info("event_received")
+
+	fileID, err := ParseFileID(key)
+
+	if err != nil {
+		log.Error("file_id_missing", "error", err)
+		p.emitMetric("MissingFileIdFailures", 1, "Count")
+		return err
+	}
+
+	filename := path.Base(key)
+	log = log.With("file_id", fileID)
+
+	// The API writes the record before the object and removes both when an
+	// upload fails, so an object without a record is being discarded.
+	file, err := p.Metadata.GetFileById(ctx, fileID)
+
+	if errors.Is(err, services.ErrNotFound) {
+		log.Warn("metadata_missing")
+		p.emitMetric("MissingMetadataSkips", 1, "Count")
+		return nil
+	}
+
+	if err != nil {
+		log.Error("metadata_lookup_failed", "error", err)
+		return err
+	}
+
+	if !p.Processable(file) {
+		if file.ProcessingState == services.StateFailed {
+			log.Warn("retries_exhausted", "attempts", file.Attempts, "last_error", file.LastError)
+			p.emitMetric("RetriesExhausted", 1, "Count")
+		} else {
+			// Events are delivered at least once.
+			log.Info("processing_skipped", "state", file.ProcessingState)
+		}
+		return nil
+	}
+
+	attempts := file.Attempts + 1
+	claim := services.Transition(file.ProcessingState, services.StateProcessing)
+	claim.Attempts = &attempts
+
+	err = p.Metadata.UpdateItem(ctx, fileID, claim)
+
+	// Another run claimed the file, or the upload is being discarded.
+	if errors.Is(err, services.ErrStateConflict) || errors.Is(err, services.ErrNotFound) {
+		log.Info("processing_skipped", "error", err)
+		return nil
+	}
+
+	if err != nil {
+		log.Error("metadata_update_failed", "error", err)
+		p.emitMetric("DynamoDBUpdateFailures", 1, "Count")
+		return err
+	}
+
+	log = log.With("attempt", attempts)
+
+	// The processor can see a direct upload before the API checks it.
+	if reason := p.checkSize(file, head.Size); reason != "" {
+		log.Warn("size_rejected", "size_bytes", head.Size, "recorded_size", file.Size)
+		p.emitMetric("FilesQuarantined", 1, "Count")
+		return p.quarantine(ctx, log, fileID, reason)
+	}
+
+	size, sniffed, sum, err := p.digest(ctx, key)
+
+	if err != nil {
+		log.Error("file_hash_failed", "error", err)
+		p.emitMetric("FileHashFailures", 1, "Count")
+		return p.fail(ctx, log, fileID, err)
+	}
+
+	log.Info("computed_sha256", "sha256", sum, "size_bytes", size)
+
+	// The API records the sha256 of what it stored; different content
+	// means the object was replaced or corrupted since.
+	if file.Sha256 != "" && sum != file.Sha256 {
+		log.Warn("sha256_mismatch", "sha256", sum, "recorded_sha256", file.Sha256)
+		p.emitMetric("FilesQuarantined", 1, "Count")
+		return p.quarantine(ctx, log, fileID, fmt.Sprintf("content sha256 %s does not match the uploaded %s", sum, file.Sha256))
+	}
+
+	processedKey, err := p.findDuplicate(ctx, fileID, sum)
+
+	if err != nil {
+		log.Error("dedupe_lookup_failed", "error", err)
+		return p.fail(ctx, log, fileID, err)
+	}
+
+	wroteOutput := processedKey == ""
+
+	if processedKey != "" {
+		log.Info("dedupe_hit", "processed_key", processedKey)
+		p.emitMetric("DedupeHits", 1, "Count")
+	} else {
+		processedKey = ProcessedKey(fileID)
+		output := Output{
+			FileID:      fileID,
+			RawFilename: filename,
+			SizeBytes:   size,
+			MimeType:    mimeType(filename, sniffed),
+			Sha256:      sum,
+			Status:      "processed",
+			TraceID:     traceID,
+		}
+
+		if err := p.writeOutput(ctx, processedKey, output, traceID); err != nil {
+			log.Error("processed_upload_failed", "error", err)
+			p.emitMetric("ProcessedUploadFailures", 1, "Count")
+			return p.fail(ctx, log, fileID, err)
+		}
+
+		log.Info("uploaded_processed_file", "processed_key", processedKey)
+	}
+
+	update := services.Transition(services.StateProcessing, services.StateDone)
+	update.ProcessedKey = &processedKey
+	update.Sha256 = &sum
+	// Set here too in case the API has not recorded it yet.
+	update.Size = &size
+
+	// Objects uploaded by older clients may carry no trace_id; keep the one
+	// recorded by the API in that case.
+	if traceID != "" {
+		update.TraceID = &traceID
+	}
+
+	err = p.Metadata.UpdateItem(ctx, fileID, update)
+
+	// The upload was discarded or the file deleted while it was being
+	// processed.
+	if errors.Is(err, services.ErrNotFound) || errors.Is(err, services.ErrStateConflict) {
+		log.Warn("metadata_changed", "error", err)
+		p.emitMetric("MissingMetadataSkips", 1, "Count")
+
+		if wroteOutput {
+			if err := p.Storage.DeleteObject(ctx, processedKey); err != nil {
+				log.Error("processed_cleanup_failed", "error", err)
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err != nil {
+		log.Error("metadata_update_failed", "error", err)
+		p.emitMetric("DynamoDBUpdateFailures", 1, "Count")
+		return p.fail(ctx, log, fileID, err)
+	}
+
+	latency := time.Since(start).Milliseconds()
+	log.Info("processing_completed", "latency_ms", latency)
+
+	p.emitMetric("ProcessingLatencyMs", float64(latency), "Milliseconds")
+	p.emitMetric("FilesProcessed", 1, "Count")
+
+	return nil
+}
+
+// Processable reports whether Process would pick file up: uploads that have
+// not been processed yet and failed files with attempts left.
+func (p *Processor) Processable(file services.FileMetadata) bool {
+	switch file.ProcessingState {
+	case services.StatePendingUpload, services.StateUploaded:
+		return true
+	case services.StateFailed:
+		return file.Attempts < p.MaxAttempts
+	}
+	return false
+}
+
+// checkSize explains why an object of size cannot be the content of file, or
+// returns "" when it can.
+func (p *Processor) checkSize(file services.FileMetadata, size int64) string {
+	if p.MaxUploadSize > 0 && size > p.MaxUploadSize {
+		return fmt.Sprintf("content of %d bytes exceeds the maximum upload size of %d", size, p.MaxUploadSize)
+	}
+	if file.Size > 0 && size != file.Size {
+		return fmt.Sprintf("content of %d bytes does not match the declared %d", size, file.Size)
+	}
+	return ""
+}
+
+// fail moves a claimed file to failed with cause as its lastError. It
+// returns cause, so the caller's retry policy still applies.
+func (p *Processor) fail(ctx context.Context, log *slog.Logger, fileID string, cause error) error {
+	update := services.Transition(services.StateProcessing, services.StateFailed)
+	update.LastError = awssdk.String(cause.Error())
+
+	// Record the failure even when it was the context that failed.
+	if err := p.Metadata.UpdateItem(context.WithoutCancel(ctx), fileID, update); err != nil {
+		log.Error("metadata_update_failed", "error", err)
+	}
+
+	p.emitMetric("ProcessingFailures", 1, "Count")
+	return cause
+}
+
+// quarantine moves a claimed file whose content is refused to quarantined.
+// Processing it again would not help, so it returns nil.
+func (p *Processor) quarantine(ctx context.Context, log *slog.Logger, fileID, reason string) error {
+	update := services.Transition(services.StateProcessing, services.StateQuarantined)
+	update.LastError = &reason
+
+	if err := p.Metadata.UpdateItem(ctx, fileID, update); err != nil {
+		log.Error("metadata_update_failed", "error", err)
+		return err
+	}
+
+	log.Warn("file_quarantined", "reason", reason)
+	return nil
+}
+
+// digest streams the object once, returning its size, the first bytes for
+// content sniffing and its hex sha256.
+func (p *Processor) digest(ctx context.Context, key string) (int64, []byte, string, error) {
+	body, _, err := p.Storage.GetObject(ctx, key)
+
+	if err != nil {
+		return 0, nil, "", fmt.Errorf("failed to download %s: %w", key, err)
+	}
+
+	defer body.Close()
+
+	hash := sha256.New()
+	sniff := &limitedBuffer{limit: 512}
+	size, err := io.Copy(io.MultiWriter(hash, sniff), body)
+
+	if err != nil {
+		return 0, nil, "", fmt.Errorf("failed to read %s: %w", key, err)
+	}
+
+	return size, sniff.Bytes(), hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// findDuplicate returns the processedKey of another record with the same
+// sha256, or "" when there is none.
+func (p *Processor) findDuplicate(ctx context.Context, fileID, sum string) (string, error) {
+	items, err := p.Metadata.FindBySha256(ctx, sum)
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, item := range items {
+		if item.ID != fileID && item.ProcessedKey != "" {
+			return item.ProcessedKey, nil
+		}
+	}
+
+	return "", nil
+}
+
+func (p *Processor) writeOutput(ctx context.Context, key string, output Output, traceID string) error {
+	data, err := json.Marshal(output)
+
+	if err != nil {
+		return fmt.Errorf("failed to marshal processed output: %w", err)
+	}
+
+	return p.Storage.PutObject(ctx, key, bytes.NewReader(data), map[string]string{
+		"trace_id": traceID,
+	})
+}
+
+func mimeType(filename string, sniffed []byte) string {
+	if t := mime.TypeByExtension(path.Ext(filename)); t != "" {
+		return t
+	}
+	return http.DetectContentType(sniffed)
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
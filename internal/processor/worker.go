@@ -0,0 +1,51 @@
+package processor
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// Worker runs the processor inside the API process. It stands in for the
+// EventBridge rule when the API runs against the local or memory backends.
+type Worker struct {
+	processor *Processor
+	queue     chan string
+	log       *slog.Logger
+}
+
+func NewWorker(p *Processor, queueSize int) *Worker {
+	return &Worker{
+		processor: p,
+		queue:     make(chan string, queueSize),
+		log:       p.Logger.With("component", "processor-worker"),
+	}
+}
+
+// NotifyUploaded queues key for processing. Like the EventBridge rule, only
+// keys under raw/ are picked up.
+func (w *Worker) NotifyUploaded(ctx context.Context, key string) {
+	if !strings.HasPrefix(key, "raw/") {
+		return
+	}
+
+	select {
+	case w.queue <- key:
+	case <-ctx.Done():
+		w.log.Error("Dropped processing request.", "key", key, "error", ctx.Err())
+	}
+}
+
+// Run processes queued keys until ctx is cancelled.
+func (w *Worker) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case key := <-w.queue:
+			if err := w.processor.Process(ctx, key); err != nil {
+				w.log.Error("Processing failed.", "key", key, "error", err)
+			}
+		}
+	}
+}
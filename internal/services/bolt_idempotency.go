@@ -0,0 +1,231 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var idempotencyBucket = []byte("idempotency")
+
+// BoltIdempotencyStore keeps idempotency records in an embedded bbolt
+// database. Expired records are dropped by a sweep run at most once per
+// idempotencySweepInterval, when a key is claimed.
+type BoltIdempotencyStore struct {
+	db *bolt.DB
+
+	mu      sync.Mutex
+	sweptAt time.Time
+}
+
+func NewBoltIdempotencyStore(path string) (*BoltIdempotencyStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create idempotency directory: %w", err)
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open idempotency database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(idempotencyBucket)
+		return err
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialise idempotency database: %w", err)
+	}
+
+	return &BoltIdempotencyStore{db: db}, nil
+}
+
+func (b *BoltIdempotencyStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltIdempotencyStore) Claim(ctx context.Context, key, token string, expiresAt time.Time) (*IdempotencyRecord, error) {
+	var existing *IdempotencyRecord
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+		now := time.Now()
+
+		if b.sweepDue(now) {
+			if err := sweepIdempotencyRecords(bucket, now); err != nil {
+				return err
+			}
+		}
+
+		record, err := getIdempotencyRecord(bucket, key)
+
+		if err != nil {
+			return err
+		}
+
+		if record != nil && record.ExpiresAt.After(now) {
+			existing = record
+			return nil
+		}
+
+		return putIdempotencyRecord(bucket, IdempotencyRecord{Key: key, Token: token, ExpiresAt: expiresAt})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("bolt claim failed: %w", err)
+	}
+
+	if existing != nil {
+		return existing, fmt.Errorf("%w: idempotency key %s is in use", ErrConflict, key)
+	}
+
+	return nil, nil
+}
+
+func (b *BoltIdempotencyStore) Renew(ctx context.Context, key, token string, expiresAt time.Time) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+		record, err := heldIdempotencyRecord(bucket, key, token)
+
+		if err != nil {
+			return err
+		}
+
+		record.ExpiresAt = expiresAt
+		return putIdempotencyRecord(bucket, *record)
+	})
+
+	if err != nil {
+		return fmt.Errorf("bolt renew failed: %w", err)
+	}
+
+	return nil
+}
+
+func (b *BoltIdempotencyStore) Complete(ctx context.Context, record IdempotencyRecord) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+
+		if _, err := heldIdempotencyRecord(bucket, record.Key, record.Token); err != nil {
+			return err
+		}
+
+		return putIdempotencyRecord(bucket, record)
+	})
+
+	if err != nil {
+		return fmt.Errorf("bolt put failed: %w", err)
+	}
+
+	return nil
+}
+
+func (b *BoltIdempotencyStore) Release(ctx context.Context, key, token string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+
+		if _, err := heldIdempotencyRecord(bucket, key, token); err != nil {
+			return err
+		}
+
+		return bucket.Delete([]byte(key))
+	})
+
+	if err != nil {
+		return fmt.Errorf("bolt delete failed: %w", err)
+	}
+
+	return nil
+}
+
+// sweepDue reports whether expired records are due to be swept, and if so
+// counts the sweep as done as of now.
+func (b *BoltIdempotencyStore) sweepDue(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Sub(b.sweptAt) < idempotencySweepInterval {
+		return false
+	}
+
+	b.sweptAt = now
+	return true
+}
+
+func sweepIdempotencyRecords(bucket *bolt.Bucket, now time.Time) error {
+	var expired [][]byte
+
+	err := bucket.ForEach(func(k, v []byte) error {
+		var record IdempotencyRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			return fmt.Errorf("failed to unmarshal idempotency record %s: %w", k, err)
+		}
+
+		if !record.ExpiresAt.After(now) {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, k := range expired {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getIdempotencyRecord returns the record for key, or nil if there is none.
+func getIdempotencyRecord(bucket *bolt.Bucket, key string) (*IdempotencyRecord, error) {
+	data := bucket.Get([]byte(key))
+
+	if data == nil {
+		return nil, nil
+	}
+
+	var record IdempotencyRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal idempotency record %s: %w", key, err)
+	}
+
+	return &record, nil
+}
+
+// heldIdempotencyRecord returns the record for key if the claim made with
+// token still holds it.
+func heldIdempotencyRecord(bucket *bolt.Bucket, key, token string) (*IdempotencyRecord, error) {
+	record, err := getIdempotencyRecord(bucket, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if record == nil || record.Token != token {
+		return nil, fmt.Errorf("%w: idempotency key %s is held by another request", ErrConflict, key)
+	}
+
+	return record, nil
+}
+
+func putIdempotencyRecord(bucket *bolt.Bucket, record IdempotencyRecord) error {
+	data, err := json.Marshal(record)
+
+	if err != nil {
+		return fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+
+	return bucket.Put([]byte(record.Key), data)
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var filesBucket = []byte("files")
+
+// BoltMetadataStore keeps FileMetadata records in an embedded bbolt database,
+// one JSON document per file id.
+type BoltMetadataStore struct {
+	db *bolt.DB
+}
+
+func NewBoltMetadataStore(path string) (*BoltMetadataStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(filesBucket)
+		return err
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialise metadata database: %w", err)
+	}
+
+	return &BoltMetadataStore{db: db}, nil
+}
+
+func (b *BoltMetadataStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltMetadataStore) GetAllItems(ctx context.Context) ([]FileMetadata, error) {
+	items := []FileMetadata{}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+			var item FileMetadata
+			if err := json.Unmarshal(v, &item); err != nil {
+				return fmt.Errorf("failed to unmarshal file metadata %s: %w", k, err)
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("bolt scan failed: %w", err)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].CreatedAt.Before(items[j].CreatedAt)
+	})
+
+	return items, nil
+}
+
+func (b *BoltMetadataStore) ListItems(ctx context.Context, query ListQuery) (*ListPage, error) {
+	items, err := b.GetAllItems(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return listPage(items, query)
+}
+
+func (b *BoltMetadataStore) CreateItem(ctx context.Context, metadata *FileMetadata) error {
+	metadata.stampCreated()
+
+	data, err := json.Marshal(metadata)
+
+	if err != nil {
+		return fmt.Errorf("failed to marshal file metadata: %w", err)
+	}
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).Put([]byte(metadata.ID), data)
+	})
+
+	if err != nil {
+		return fmt.Errorf("bolt put failed: %w", err)
+	}
+
+	return nil
+}
+
+func (b *BoltMetadataStore) GetFileById(ctx context.Context, id string) (FileMetadata, error) {
+	fileMetadata := FileMetadata{}
+	found := false
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(filesBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &fileMetadata)
+	})
+
+	if err != nil {
+		return fileMetadata, fmt.Errorf("bolt get failed: %w", err)
+	}
+
+	if !found {
+		return fileMetadata, fmt.Errorf("%w: file %s", ErrNotFound, id)
+	}
+
+	return fileMetadata, nil
+}
+
+func (b *BoltMetadataStore) UpdateItem(ctx context.Context, id string, update FileUpdate) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(filesBucket)
+		data := bucket.Get([]byte(id))
+
+		if data == nil {
+			return fmt.Errorf("%w: file %s", ErrNotFound, id)
+		}
+
+		var item FileMetadata
+		if err := json.Unmarshal(data, &item); err != nil {
+			return err
+		}
+
+		if err := update.check(item); err != nil {
+			return err
+		}
+
+		update.apply(&item)
+
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(id), data)
+	})
+
+	if err != nil {
+		return fmt.Errorf("bolt update failed: %w", err)
+	}
+
+	return nil
+}
+
+func (b *BoltMetadataStore) FindBySha256(ctx context.Context, sha256 string) ([]FileMetadata, error) {
+	all, err := b.GetAllItems(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	items := []FileMetadata{}
+	for _, item := range all {
+		if item.Sha256 == sha256 {
+			items = append(items, item)
+		}
+	}
+
+	return items, nil
+}
+
+func (b *BoltMetadataStore) DeleteItem(ctx context.Context, id string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).Delete([]byte(id))
+	})
+
+	if err != nil {
+		return fmt.Errorf("bolt delete failed: %w", err)
+	}
+
+	return nil
+}
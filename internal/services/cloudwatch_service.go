@@ -5,106 +5,277 @@ import (
 	"fmt"
 	"log/slog"
 	"s3-analytics/internal/aws"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
-	"github.com/aws/jsii-runtime-go"
 )
 
+const (
+	cloudWatchNamespace = "FilePipeline/API"
+
+	// maxDatumsPerPut is the PutMetricData limit on datums per call.
+	maxDatumsPerPut = 1000
+
+	// publishTimeout bounds a single PutMetricData call.
+	publishTimeout = 10 * time.Second
+)
+
+const (
+	DefaultMetricsFlushInterval = 15 * time.Second
+	DefaultMetricsQueueSize     = 10000
+)
+
+// CloudWatchOptions tunes how CloudWatchService batches metrics. Zero fields
+// take the defaults.
+type CloudWatchOptions struct {
+	// FlushInterval is how often buffered metrics are published.
+	FlushInterval time.Duration
+	// QueueSize bounds the samples waiting to be aggregated. Samples that
+	// arrive while the queue is full are dropped and counted.
+	QueueSize int
+	// MaxBatchSize is how many distinct datums may be pending before they are
+	// published ahead of the interval.
+	MaxBatchSize int
+}
+
+// CloudWatchService publishes request metrics to CloudWatch in batches. The
+// Emit methods only enqueue a sample; one background goroutine merges the
+// samples into a statistic set per metric, endpoint and status code and
+// publishes them every FlushInterval, or sooner once MaxBatchSize datums are
+// pending. Close publishes whatever is still buffered.
 type CloudWatchService struct {
-	client *cloudwatch.Client 
+	client  *cloudwatch.Client
+	options CloudWatchOptions
+	log     *slog.Logger
+
+	queue   chan requestSample
+	dropped atomic.Int64
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func NewCloudWatchService(cw *aws.CloudWatchClient) *CloudWatchService {
-	return &CloudWatchService{
-		client: cw.Client,
+// requestSample is one call to EmitAsyncMetrics or EmitAsyncFailure.
+type requestSample struct {
+	endpoint string
+	status   int
+	latency  int
+	failure  bool
+}
+
+// datumKey identifies one aggregated datum. status is zero for metrics
+// without a StatusCode dimension.
+type datumKey struct {
+	name     string
+	endpoint string
+	status   int
+}
+
+type statistics struct {
+	unit                 types.StandardUnit
+	count, sum, min, max float64
+}
+
+func (s *statistics) add(value float64) {
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+	if s.count == 0 || value > s.max {
+		s.max = value
 	}
+	s.count++
+	s.sum += value
 }
 
-func (cw *CloudWatchService) PutMetrics(ctx context.Context, endpoint string, latency int) error {
-	_, err := cw.client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
-		Namespace: jsii.String("FilePipeline/API"),
-		MetricData: []types.MetricDatum{
-			{
-				MetricName: jsii.String("RequestsCount"),
-				Unit: types.StandardUnitCount,
-				Value: jsii.Number(1),
-				Dimensions: []types.Dimension{
-					{Name: jsii.String("Endpoint"), Value: jsii.String(endpoint)},
-				},
-			},
-			{
-				MetricName: jsii.String("RequestLatencyMs"),
-				Unit: types.StandardUnitMilliseconds,
-				Value: jsii.Number(float64(latency)),
-				Dimensions: []types.Dimension{
-					{Name: jsii.String("Endpoint"), Value: jsii.String(endpoint)},
-				},
+func NewCloudWatchService(cw *aws.CloudWatchClient, options CloudWatchOptions, log *slog.Logger) *CloudWatchService {
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultMetricsFlushInterval
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultMetricsQueueSize
+	}
+	if options.MaxBatchSize <= 0 {
+		options.MaxBatchSize = maxDatumsPerPut
+	}
+
+	service := &CloudWatchService{
+		client:  cw.Client,
+		options: options,
+		log:     log,
+		queue:   make(chan requestSample, options.QueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go service.run()
+
+	return service
+}
+
+// EmitAsyncMetrics queues the request's count, latency and status code. The
+// request context is not used: it is cancelled once the response is written,
+// long before the batch is published.
+func (cw *CloudWatchService) EmitAsyncMetrics(ctx context.Context, endpoint string, status int, latency int, log *slog.Logger) {
+	cw.enqueue(requestSample{endpoint: endpoint, status: status, latency: latency})
+}
+
+// EmitAsyncFailure queues a failure for endpoint.
+func (cw *CloudWatchService) EmitAsyncFailure(ctx context.Context, endpoint string, log *slog.Logger) {
+	cw.enqueue(requestSample{endpoint: endpoint, failure: true})
+}
+
+// Dropped returns how many samples have been dropped because the queue was
+// full.
+func (cw *CloudWatchService) Dropped() int64 {
+	return cw.dropped.Load()
+}
+
+// Close stops the publisher after publishing everything queued so far. It
+// returns early with ctx's error if ctx ends first.
+func (cw *CloudWatchService) Close(ctx context.Context) error {
+	cw.closeOnce.Do(func() { close(cw.stop) })
+
+	select {
+	case <-cw.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to flush metrics: %w", ctx.Err())
+	}
+}
+
+func (cw *CloudWatchService) enqueue(sample requestSample) {
+	select {
+	case cw.queue <- sample:
+	default:
+		cw.dropped.Add(1)
+	}
+}
+
+func (cw *CloudWatchService) run() {
+	defer close(cw.done)
+
+	ticker := time.NewTicker(cw.options.FlushInterval)
+	defer ticker.Stop()
+
+	pending := map[datumKey]*statistics{}
+	var reported int64
+
+	flush := func() {
+		// Drops are published as a metric of their own so they show up next
+		// to the numbers they make incomplete.
+		if dropped := cw.dropped.Load(); dropped > reported {
+			cw.log.Warn("Dropped metrics because the queue was full.", "dropped", dropped-reported)
+			record(pending, datumKey{name: "MetricsDropped"}, types.StandardUnitCount, float64(dropped-reported))
+			reported = dropped
+		}
+
+		if len(pending) == 0 {
+			return
+		}
+
+		cw.publish(pending)
+		clear(pending)
+	}
+
+	for {
+		select {
+		case sample := <-cw.queue:
+			aggregate(pending, sample)
+
+			if len(pending) >= cw.options.MaxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-cw.stop:
+			for len(cw.queue) > 0 {
+				aggregate(pending, <-cw.queue)
+			}
+
+			flush()
+			return
+		}
+	}
+}
+
+// aggregate merges sample into pending.
+func aggregate(pending map[datumKey]*statistics, sample requestSample) {
+	if sample.failure {
+		record(pending, datumKey{name: "RequestFailures", endpoint: sample.endpoint}, types.StandardUnitCount, 1)
+		return
+	}
+
+	record(pending, datumKey{name: "RequestsCount", endpoint: sample.endpoint}, types.StandardUnitCount, 1)
+	record(pending, datumKey{name: "RequestLatencyMs", endpoint: sample.endpoint}, types.StandardUnitMilliseconds, float64(sample.latency))
+	record(pending, datumKey{name: "ResponsesCount", endpoint: sample.endpoint, status: sample.status}, types.StandardUnitCount, 1)
+}
+
+func record(pending map[datumKey]*statistics, key datumKey, unit types.StandardUnit, value float64) {
+	s, ok := pending[key]
+	if !ok {
+		s = &statistics{unit: unit}
+		pending[key] = s
+	}
+	s.add(value)
+}
+
+// publish sends pending as statistic sets, splitting it into as many
+// PutMetricData calls as the per-call limit requires. A failed call is
+// logged and its datums discarded so the buffer stays bounded.
+func (cw *CloudWatchService) publish(pending map[datumKey]*statistics) {
+	now := time.Now()
+	data := make([]types.MetricDatum, 0, len(pending))
+
+	for key, s := range pending {
+		datum := types.MetricDatum{
+			MetricName: awssdk.String(key.name),
+			Unit:       s.unit,
+			Timestamp:  &now,
+			StatisticValues: &types.StatisticSet{
+				SampleCount: awssdk.Float64(s.count),
+				Sum:         awssdk.Float64(s.sum),
+				Minimum:     awssdk.Float64(s.min),
+				Maximum:     awssdk.Float64(s.max),
 			},
-		},
-	})
+		}
 
-	if err != nil {
-		return fmt.Errorf("failed to add metrics: %w", err)
+		if key.endpoint != "" {
+			datum.Dimensions = append(datum.Dimensions, types.Dimension{Name: awssdk.String("Endpoint"), Value: awssdk.String(key.endpoint)})
+		}
+
+		if key.status != 0 {
+			datum.Dimensions = append(datum.Dimensions, types.Dimension{Name: awssdk.String("StatusCode"), Value: awssdk.String(strconv.Itoa(key.status))})
+		}
+
+		data = append(data, datum)
+	}
+
+	for start := 0; start < len(data); start += maxDatumsPerPut {
+		batch := data[start:min(start+maxDatumsPerPut, len(data))]
+
+		if err := cw.put(batch); err != nil {
+			cw.log.Error("Failed to publish metrics", "error", err, "datums", len(batch))
+		}
 	}
-	return nil
 }
 
-func (cw *CloudWatchService) PutFailureMetric(ctx context.Context, endpoint string) error {
-    _, err := cw.client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
-        Namespace: jsii.String("FilePipeline/API"),
-        MetricData: []types.MetricDatum{
-            {
-                MetricName: jsii.String("RequestFailures"),
-                Unit: types.StandardUnitCount,
-                Value: jsii.Number(1),
-                Dimensions: []types.Dimension{
-                    {Name: jsii.String("Endpoint"), Value: jsii.String(endpoint)},
-                },
-            },
-        },
-    })
+func (cw *CloudWatchService) put(data []types.MetricDatum) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	_, err := cw.client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+		Namespace:  awssdk.String(cloudWatchNamespace),
+		MetricData: data,
+	})
+
 	if err != nil {
 		return fmt.Errorf("failed to add metrics: %w", err)
 	}
 	return nil
 }
-
-func (cw *CloudWatchService) EmitAsyncMetrics(
-    ctx context.Context,
-    endpoint string,
-    latency int,
-    log *slog.Logger,
-) {
-    go func() {
-        // Protect against panics inside the goroutine
-        defer func() {
-            if r := recover(); r != nil {
-                log.Error("panic in metrics goroutine", "panic", r)
-            }
-        }()
-
-        // Emit success metrics
-        if err := cw.PutMetrics(ctx, endpoint, latency); err != nil {
-            log.Error("Failed to publish metrics", "error", err)
-        }
-    }()
-}
-
-func (cw *CloudWatchService) EmitAsyncFailure(
-    ctx context.Context,
-    endpoint string,
-    log *slog.Logger,
-) {
-    go func() {
-        defer func() {
-            if r := recover(); r != nil {
-                log.Error("panic in metrics goroutine", "panic", r)
-            }
-        }()
-
-        if err := cw.PutFailureMetric(ctx, endpoint); err != nil {
-            log.Error("Failed to publish failure metric", "error", err)
-        }
-    }()
-}
\ No newline at end of file
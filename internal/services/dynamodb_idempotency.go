@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"s3-analytics/internal/aws"
+	"strconv"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBIdempotencyStore keeps idempotency records in their own table,
+// keyed by idempotencyKey. The table's TTL attribute should be expiresAt so
+// DynamoDB deletes expired records; until it does they are treated as
+// absent.
+type DynamoDBIdempotencyStore struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoDBIdempotencyStore(d *aws.DynamoDBClient) *DynamoDBIdempotencyStore {
+	return &DynamoDBIdempotencyStore{
+		client:    d.Client,
+		tableName: d.TableName,
+	}
+}
+
+func (d *DynamoDBIdempotencyStore) Claim(ctx context.Context, key, token string, expiresAt time.Time) (*IdempotencyRecord, error) {
+	item, err := attributevalue.MarshalMap(IdempotencyRecord{Key: key, Token: token, ExpiresAt: expiresAt})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           &d.tableName,
+		Item:                item,
+		ConditionExpression: awssdk.String("attribute_not_exists(idempotencyKey) OR expiresAt <= :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		existing := &IdempotencyRecord{}
+
+		if err := attributevalue.UnmarshalMap(conditionFailed.Item, existing); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal idempotency record: %w", err)
+		}
+		return existing, fmt.Errorf("%w: idempotency key %s is in use", ErrConflict, key)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb PutItem failed: %w", awsError(err))
+	}
+
+	return nil, nil
+}
+
+func (d *DynamoDBIdempotencyStore) Renew(ctx context.Context, key, token string, expiresAt time.Time) error {
+	_, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &d.tableName,
+		Key:                 idempotencyItemKey(key),
+		UpdateExpression:    awssdk.String("SET expiresAt = :expiresAt"),
+		ConditionExpression: awssdk.String(idempotencyHeld),
+		ExpressionAttributeNames: map[string]string{
+			"#token": "token",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+			":token":     &types.AttributeValueMemberS{Value: token},
+		},
+	})
+
+	if err != nil {
+		return fmt.Errorf("dynamodb UpdateItem failed: %w", idempotencyError(err, key))
+	}
+
+	return nil
+}
+
+func (d *DynamoDBIdempotencyStore) Complete(ctx context.Context, record IdempotencyRecord) error {
+	item, err := attributevalue.MarshalMap(record)
+
+	if err != nil {
+		return fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           &d.tableName,
+		Item:                item,
+		ConditionExpression: awssdk.String(idempotencyHeld),
+		ExpressionAttributeNames: map[string]string{
+			"#token": "token",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":token": &types.AttributeValueMemberS{Value: record.Token},
+		},
+	})
+
+	if err != nil {
+		return fmt.Errorf("dynamodb PutItem failed: %w", idempotencyError(err, record.Key))
+	}
+
+	return nil
+}
+
+func (d *DynamoDBIdempotencyStore) Release(ctx context.Context, key, token string) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           &d.tableName,
+		Key:                 idempotencyItemKey(key),
+		ConditionExpression: awssdk.String(idempotencyHeld),
+		ExpressionAttributeNames: map[string]string{
+			"#token": "token",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":token": &types.AttributeValueMemberS{Value: token},
+		},
+	})
+
+	if err != nil {
+		return fmt.Errorf("dynamodb DeleteItem failed: %w", idempotencyError(err, key))
+	}
+
+	return nil
+}
+
+// idempotencyHeld is the condition that the claim made with :token still
+// holds the record. It fails once the record was claimed again or deleted.
+const idempotencyHeld = "#token = :token"
+
+func idempotencyItemKey(key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"idempotencyKey": &types.AttributeValueMemberS{Value: key},
+	}
+}
+
+// idempotencyError reports a failed idempotencyHeld condition as ErrConflict.
+func idempotencyError(err error, key string) error {
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return fmt.Errorf("%w: idempotency key %s is held by another request", ErrConflict, key)
+	}
+	return awsError(err)
+}
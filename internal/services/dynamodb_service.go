@@ -2,86 +2,403 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"maps"
 	"s3-analytics/internal/aws"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
-type DynamoDBService struct {
-	client *dynamodb.Client
-	tableName string
+// sortableTimeFormat is RFC3339 with fixed nanosecond precision. Unlike
+// RFC3339Nano it keeps trailing zeros, so stored times compare as strings in
+// time order, which the createdAt sort key of the StateCreatedAtIndex needs.
+const sortableTimeFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
+// encodeTimes makes the attributevalue encoder store times in
+// sortableTimeFormat.
+func encodeTimes(o *attributevalue.EncoderOptions) {
+	o.EncodeTime = func(t time.Time) (types.AttributeValue, error) {
+		return &types.AttributeValueMemberS{Value: t.UTC().Format(sortableTimeFormat)}, nil
+	}
 }
 
-type FileMetadata struct {
-    ID              string    `dynamodbav:"id"`
-    Filename        string    `dynamodbav:"filename"`
-    Size            int64     `dynamodbav:"size"`
-    ProcessingState string    `dynamodbav:"processingState"`
-    CreatedAt       time.Time `dynamodbav:"createdAt"`
-    Sha256          string    `dynamodbav:"sha256,omitempty"`
-    ProcessedKey    string    `dynamodbav:"processedKey,omitempty"`
+type DynamoDBService struct {
+	client    *dynamodb.Client
+	tableName string
 }
 
 func NewDynamoDBService(d *aws.DynamoDBClient) *DynamoDBService {
 	return &DynamoDBService{
-		client: d.Client,
+		client:    d.Client,
 		tableName: d.TableName,
 	}
 }
 
-func (d *DynamoDBService) GetAllItems(ctx context.Context) (*dynamodb.ScanOutput, error) {
-
-	res, err := d.client.Scan(ctx, &dynamodb.ScanInput{
+// GetAllItems scans the whole table, following LastEvaluatedKey across
+// pages. Use ListItems for anything user-facing.
+func (d *DynamoDBService) GetAllItems(ctx context.Context) ([]FileMetadata, error) {
+	items := []FileMetadata{}
+	paginator := dynamodb.NewScanPaginator(d.client, &dynamodb.ScanInput{
 		TableName: &d.tableName,
 	})
 
+	for paginator.HasMorePages() {
+		res, err := paginator.NextPage(ctx)
+
+		if err != nil {
+			return nil, fmt.Errorf("dynamodb scan failed: %w", awsError(err))
+		}
+
+		page := []FileMetadata{}
+		err = attributevalue.UnmarshalListOfMaps(res.Items, &page)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal scan output: %w", err)
+		}
+
+		items = append(items, page...)
+	}
+
+	return items, nil
+}
+
+// ListItems serves a page from the StateCreatedAtIndex. Without a state
+// filter it queries every state and merges the results by createdAt.
+func (d *DynamoDBService) ListItems(ctx context.Context, q ListQuery) (*ListPage, error) {
+	cursor, err := decodeCursor(q.Cursor)
+
 	if err != nil {
-		return nil, fmt.Errorf("dynamodb scan failed: %w", err)
+		return nil, err
+	}
+
+	states := States
+	if q.State != "" {
+		states = []State{q.State}
+	} else if !q.IncludeDeleted {
+		states = slices.DeleteFunc(slices.Clone(States), func(s State) bool { return s == StateDeleted })
+	}
+
+	limit := q.limit()
+	items := []FileMetadata{}
+
+	for _, state := range states {
+		// One extra record tells us whether there is another page.
+		found, err := d.queryState(ctx, state, q, cursor, limit+1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, found...)
 	}
 
-	return res, nil 
+	slices.SortFunc(items, q.compare)
+
+	return truncatePage(items, limit), nil
 }
 
-func (d *DynamoDBService) CreateItem(ctx context.Context, metadata *FileMetadata) (*dynamodb.PutItemOutput, error)  {
-	
-	item, err := attributevalue.MarshalMap(metadata)
-	
+// queryState returns up to want records in state that match q and come
+// after cursor, in q's order.
+func (d *DynamoDBService) queryState(ctx context.Context, state State, q ListQuery, cursor *listCursor, want int) ([]FileMetadata, error) {
+	names := map[string]string{"#state": "processingState", "#created": "createdAt"}
+	values := map[string]types.AttributeValue{":state": &types.AttributeValueMemberS{Value: string(state)}}
+
+	// The sort key range is inclusive; the exclusive bounds and ties on the
+	// cursor's createdAt are dropped by matches and afterCursor below.
+	lower, upper := q.CreatedAfter, q.CreatedBefore
+	if cursor != nil {
+		if q.Descending && (upper.IsZero() || cursor.CreatedAt.Before(upper)) {
+			upper = cursor.CreatedAt
+		}
+		if !q.Descending && cursor.CreatedAt.After(lower) {
+			lower = cursor.CreatedAt
+		}
+	}
+
+	keyCondition := "#state = :state"
+
+	switch {
+	case !lower.IsZero() && !upper.IsZero():
+		keyCondition += " AND #created BETWEEN :lower AND :upper"
+	case !lower.IsZero():
+		keyCondition += " AND #created >= :lower"
+	case !upper.IsZero():
+		keyCondition += " AND #created <= :upper"
+	}
+
+	if !lower.IsZero() {
+		values[":lower"] = &types.AttributeValueMemberS{Value: lower.UTC().Format(sortableTimeFormat)}
+	}
+	if !upper.IsZero() {
+		values[":upper"] = &types.AttributeValueMemberS{Value: upper.UTC().Format(sortableTimeFormat)}
+	}
+
+	filters := []string{}
+
+	if !q.IncludeDeleted {
+		names["#deleted"] = "deletedAt"
+		filters = append(filters, "attribute_not_exists(#deleted)")
+	}
+	if q.MinSize != nil {
+		names["#size"] = "size"
+		values[":minSize"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(*q.MinSize, 10)}
+		filters = append(filters, "#size >= :minSize")
+	}
+	if q.MaxSize != nil {
+		names["#size"] = "size"
+		values[":maxSize"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(*q.MaxSize, 10)}
+		filters = append(filters, "#size <= :maxSize")
+	}
+	if q.FilenamePrefix != "" {
+		names["#filename"] = "filename"
+		values[":prefix"] = &types.AttributeValueMemberS{Value: q.FilenamePrefix}
+		filters = append(filters, "begins_with(#filename, :prefix)")
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 &d.tableName,
+		IndexName:                 awssdk.String(StateCreatedAtIndexName),
+		KeyConditionExpression:    &keyCondition,
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ScanIndexForward:          awssdk.Bool(!q.Descending),
+		Limit:                     awssdk.Int32(int32(want)),
+	}
+
+	if len(filters) > 0 {
+		input.FilterExpression = awssdk.String(strings.Join(filters, " AND "))
+	}
+
+	items := []FileMetadata{}
+	paginator := dynamodb.NewQueryPaginator(d.client, input)
+
+	for paginator.HasMorePages() && len(items) < want {
+		res, err := paginator.NextPage(ctx)
+
+		if err != nil {
+			return nil, fmt.Errorf("dynamodb query on %s failed: %w", StateCreatedAtIndexName, awsError(err))
+		}
+
+		page := []FileMetadata{}
+		err = attributevalue.UnmarshalListOfMaps(res.Items, &page)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal query output: %w", err)
+		}
+
+		for _, item := range page {
+			if q.matches(item) && q.afterCursor(item, cursor) && len(items) < want {
+				items = append(items, item)
+			}
+		}
+	}
+
+	return items, nil
+}
+
+func (d *DynamoDBService) CreateItem(ctx context.Context, metadata *FileMetadata) error {
+	metadata.stampCreated()
+
+	item, err := attributevalue.MarshalMapWithOptions(metadata, encodeTimes)
+
 	if err != nil {
-		return nil, fmt.Errorf("Got error marshalling new movie item: %s", err)
+		return fmt.Errorf("failed to marshal file metadata: %w", err)
 	}
 
-	res, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
 		TableName: &d.tableName,
-		Item: item,
+		Item:      item,
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("dynamodb PutItem failed: %w", err)
+		return fmt.Errorf("dynamodb PutItem failed: %w", awsError(err))
 	}
 
-	return res, nil
+	return nil
 }
 
 func (d *DynamoDBService) GetFileById(ctx context.Context, id string) (FileMetadata, error) {
-	fileMetadata := FileMetadata{ID: id}
+	fileMetadata := FileMetadata{}
+
 	response, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
-		Key: fileMetadata.GetKey(), 
+		Key:       FileMetadata{ID: id}.GetKey(),
 		TableName: &d.tableName,
 	})
+
 	if err != nil {
-		log.Printf("Couldn't get info about file %v. Here's why: %v\n", id, err)
-	} else {
-		err = attributevalue.UnmarshalMap(response.Item, &fileMetadata)
+		return fileMetadata, fmt.Errorf("dynamodb GetItem failed: %w", awsError(err))
+	}
+
+	if len(response.Item) == 0 {
+		return fileMetadata, fmt.Errorf("%w: file %s", ErrNotFound, id)
+	}
+
+	err = attributevalue.UnmarshalMap(response.Item, &fileMetadata)
+
+	if err != nil {
+		return fileMetadata, fmt.Errorf("failed to unmarshal file metadata: %w", err)
+	}
+
+	return fileMetadata, nil
+}
+
+func (d *DynamoDBService) UpdateItem(ctx context.Context, id string, update FileUpdate) error {
+	if err := update.validate(); err != nil {
+		return err
+	}
+
+	fields := update.attributes()
+	removals := update.removals()
+
+	if len(fields) == 0 && len(removals) == 0 {
+		return nil
+	}
+
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+	sets := make([]string, 0, len(fields))
+
+	for i, name := range slices.Sorted(maps.Keys(fields)) {
+		value, err := attributevalue.MarshalWithOptions(fields[name], encodeTimes)
+
 		if err != nil {
-			log.Printf("Couldn't unmarshal response. Here's why: %v\n", err)
+			return fmt.Errorf("failed to marshal %s: %w", name, err)
+		}
+
+		names[fmt.Sprintf("#f%d", i)] = name
+		values[fmt.Sprintf(":v%d", i)] = value
+		sets = append(sets, fmt.Sprintf("#f%d = :v%d", i, i))
+	}
+
+	removes := make([]string, 0, len(removals))
+
+	for i, name := range removals {
+		names[fmt.Sprintf("#r%d", i)] = name
+		removes = append(removes, fmt.Sprintf("#r%d", i))
+	}
+
+	expression := ""
+
+	if len(sets) > 0 {
+		expression = "SET " + strings.Join(sets, ", ")
+	}
+
+	if len(removes) > 0 {
+		expression += " REMOVE " + strings.Join(removes, ", ")
+	}
+
+	// Refuse to create a partial record when the id does not exist.
+	condition := "attribute_exists(id)"
+
+	if update.ExpectState != nil {
+		names["#state"] = "processingState"
+		values[":expected"] = &types.AttributeValueMemberS{Value: string(*update.ExpectState)}
+		condition += " AND #state = :expected"
+	}
+
+	if update.ExpectOffset != nil {
+		names["#offset"] = "uploadOffset"
+		values[":expectedOffset"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(*update.ExpectOffset, 10)}
+		condition += " AND (#offset = :expectedOffset"
+		// A zero offset is omitted from the stored record.
+		if *update.ExpectOffset == 0 {
+			condition += " OR attribute_not_exists(#offset)"
+		}
+		condition += ")"
+	}
+
+	if update.ExpectLease != nil {
+		names["#lease"] = "uploadLease"
+		values[":expectedLease"] = &types.AttributeValueMemberS{Value: *update.ExpectLease}
+		condition += " AND #lease = :expectedLease"
+	}
+
+	if update.ExpectLeaseFree != nil {
+		names["#lease"] = "uploadLease"
+		names["#leaseUntil"] = "uploadLeaseUntil"
+		values[":noLease"] = &types.AttributeValueMemberS{Value: ""}
+		values[":leaseCheck"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(update.ExpectLeaseFree.Unix(), 10)}
+		condition += " AND (attribute_not_exists(#lease) OR #lease = :noLease OR #leaseUntil < :leaseCheck)"
+	}
+
+	if update.ExpectDeleted != nil {
+		names["#deleted"] = "deletedAt"
+		if *update.ExpectDeleted {
+			condition += " AND attribute_exists(#deleted)"
+		} else {
+			condition += " AND attribute_not_exists(#deleted)"
+		}
+	}
+
+	_, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 &d.tableName,
+		Key:                       FileMetadata{ID: id}.GetKey(),
+		UpdateExpression:          awssdk.String(strings.TrimSpace(expression)),
+		ConditionExpression:       awssdk.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		// Tells a missing record apart from one that fails the expectations.
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		if len(conditionFailed.Item) == 0 {
+			return fmt.Errorf("%w: file %s", ErrNotFound, id)
 		}
+		return fmt.Errorf("%w: file %s", ErrStateConflict, id)
+	}
+
+	if err != nil {
+		return fmt.Errorf("dynamodb UpdateItem failed: %w", awsError(err))
+	}
+
+	return nil
+}
+
+func (d *DynamoDBService) FindBySha256(ctx context.Context, sha256 string) ([]FileMetadata, error) {
+	res, err := d.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              &d.tableName,
+		IndexName:              awssdk.String(Sha256IndexName),
+		KeyConditionExpression: awssdk.String("sha256 = :h"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":h": &types.AttributeValueMemberS{Value: sha256},
+		},
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb query on %s failed: %w", Sha256IndexName, awsError(err))
+	}
+
+	items := []FileMetadata{}
+	err = attributevalue.UnmarshalListOfMaps(res.Items, &items)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query output: %w", err)
 	}
-	return fileMetadata, err
+
+	return items, nil
+}
+
+func (d *DynamoDBService) DeleteItem(ctx context.Context, id string) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &d.tableName,
+		Key:       FileMetadata{ID: id}.GetKey(),
+	})
+
+	if err != nil {
+		return fmt.Errorf("dynamodb DeleteItem failed: %w", awsError(err))
+	}
+
+	return nil
 }
 
 func (fm FileMetadata) GetKey() map[string]types.AttributeValue {
@@ -91,3 +408,20 @@ func (fm FileMetadata) GetKey() map[string]types.AttributeValue {
 	}
 	return map[string]types.AttributeValue{"id": id}
 }
+
+// CheckHealth reports whether the table exists and can serve requests.
+func (d *DynamoDBService) CheckHealth(ctx context.Context) error {
+	out, err := d.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: &d.tableName,
+	})
+
+	if err != nil {
+		return fmt.Errorf("dynamodb DescribeTable failed: %w", awsError(err))
+	}
+
+	switch out.Table.TableStatus {
+	case types.TableStatusActive, types.TableStatusUpdating:
+		return nil
+	}
+	return fmt.Errorf("%w: table %s is %s", ErrUnavailable, d.tableName, out.Table.TableStatus)
+}
@@ -0,0 +1,44 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"s3-analytics/internal/logging"
+	"strconv"
+)
+
+// EMFMetrics writes request metrics as CloudWatch Embedded Metric Format log
+// lines through the request logger, the same way the processor reports its
+// metrics. CloudWatch Logs turns them into FilePipeline/API metrics, so
+// publishing costs no API calls.
+type EMFMetrics struct{}
+
+func NewEMFMetrics() *EMFMetrics {
+	return &EMFMetrics{}
+}
+
+func (EMFMetrics) EmitAsyncMetrics(ctx context.Context, endpoint string, status int, latency int, log *slog.Logger) {
+	logging.EmitMetrics(log,
+		logging.MetricSet{
+			Namespace:  cloudWatchNamespace,
+			Dimensions: map[string]string{"Endpoint": endpoint},
+			Metrics: []logging.Metric{
+				{Name: "RequestsCount", Unit: "Count", Value: 1},
+				{Name: "RequestLatencyMs", Unit: "Milliseconds", Value: float64(latency)},
+			},
+		},
+		logging.MetricSet{
+			Namespace:  cloudWatchNamespace,
+			Dimensions: map[string]string{"Endpoint": endpoint, "StatusCode": strconv.Itoa(status)},
+			Metrics:    []logging.Metric{{Name: "ResponsesCount", Unit: "Count", Value: 1}},
+		},
+	)
+}
+
+func (EMFMetrics) EmitAsyncFailure(ctx context.Context, endpoint string, log *slog.Logger) {
+	logging.EmitMetrics(log, logging.MetricSet{
+		Namespace:  cloudWatchNamespace,
+		Dimensions: map[string]string{"Endpoint": endpoint},
+		Metrics:    []logging.Metric{{Name: "RequestFailures", Unit: "Count", Value: 1}},
+	})
+}
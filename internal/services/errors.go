@@ -0,0 +1,97 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+)
+
+// Kinds of failure the services report. Errors returned by the stores wrap
+// one of these, so callers can branch with errors.Is regardless of backend.
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("conflict")
+	ErrValidation  = errors.New("validation failed")
+	ErrUnavailable = errors.New("upstream unavailable")
+	ErrThrottled   = errors.New("throttled")
+)
+
+// kindError tags an underlying error with the kind it maps to without
+// changing its message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string   { return e.err.Error() }
+func (e *kindError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// awsError classifies an AWS SDK error. Errors it does not recognise are
+// returned unchanged.
+func awsError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if kind := awsErrorKind(err); kind != nil {
+		return &kindError{kind: kind, err: err}
+	}
+
+	return err
+}
+
+func awsErrorKind(err error) error {
+	var apiErr smithy.APIError
+
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound", "NoSuchUpload":
+			return ErrNotFound
+		case "NoSuchBucket", "ResourceNotFoundException":
+			// The bucket or table itself is missing. That is a broken
+			// deployment rather than a missing file, so it is reported as
+			// an outage and logged for the operator.
+			slog.Error("AWS resource not found; check the configured bucket and table names.", "code", apiErr.ErrorCode(), "error", err)
+			return ErrUnavailable
+		case "ValidationException":
+			// DynamoDB rejected a request this service built, which is a
+			// bug here rather than bad client input.
+			return nil
+		case "ConditionalCheckFailedException", "TransactionConflictException", "PreconditionFailed":
+			return ErrConflict
+		case "InvalidArgument", "InvalidPart", "InvalidPartOrder", "EntityTooSmall", "EntityTooLarge", "InvalidRange":
+			return ErrValidation
+		}
+
+		if retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err).Bool() {
+			return ErrThrottled
+		}
+	}
+
+	var responseErr *awshttp.ResponseError
+
+	if errors.As(err, &responseErr) {
+		switch status := responseErr.HTTPStatusCode(); {
+		case status == http.StatusNotFound:
+			return ErrNotFound
+		case status == http.StatusTooManyRequests:
+			return ErrThrottled
+		case status >= http.StatusInternalServerError:
+			return ErrUnavailable
+		}
+	}
+
+	var netErr net.Error
+
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrUnavailable
+	}
+
+	return nil
+}
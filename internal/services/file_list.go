@@ -0,0 +1,161 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// StateCreatedAtIndexName is the GSI on the metadata table keyed by
+// processingState and sorted by createdAt. Listings are served from it.
+const StateCreatedAtIndexName = "StateCreatedAtIndex"
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 1000
+)
+
+// States lists every processing state a record can be in. Listings without
+// a state filter query the StateCreatedAtIndex once per state.
+var States = []State{StatePendingUpload, StateUploaded, StateProcessing, StateDone, StateFailed, StateQuarantined, StateDeleted}
+
+// ErrInvalidCursor is returned by ListItems for a cursor it did not issue.
+var ErrInvalidCursor = fmt.Errorf("%w: invalid cursor", ErrValidation)
+
+// ListQuery selects one page of FileMetadata records. Zero fields do not
+// filter.
+type ListQuery struct {
+	Limit  int
+	Cursor string
+
+	State          State
+	CreatedAfter   time.Time
+	CreatedBefore  time.Time
+	MinSize        *int64
+	MaxSize        *int64
+	FilenamePrefix string
+
+	// Descending returns the newest records first.
+	Descending bool
+	// IncludeDeleted also returns soft-deleted records.
+	IncludeDeleted bool
+}
+
+// ListPage is one page of a listing. NextCursor is empty on the last page.
+type ListPage struct {
+	Items      []FileMetadata
+	NextCursor string
+}
+
+// listCursor is the position of the last record on a page. Records are
+// ordered by createdAt and then id, so it is valid across every state.
+type listCursor struct {
+	CreatedAt time.Time `json:"c"`
+	ID        string    `json:"i"`
+}
+
+func encodeCursor(fm FileMetadata) string {
+	data, _ := json.Marshal(listCursor{CreatedAt: fm.CreatedAt, ID: fm.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) (*listCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+
+	var c listCursor
+
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return nil, fmt.Errorf("%w: malformed position", ErrInvalidCursor)
+	}
+
+	return &c, nil
+}
+
+// limit returns the page size, defaulted and capped.
+func (q ListQuery) limit() int {
+	if q.Limit <= 0 {
+		return DefaultListLimit
+	}
+	return min(q.Limit, MaxListLimit)
+}
+
+// matches reports whether fm passes the query's filters.
+func (q ListQuery) matches(fm FileMetadata) bool {
+	switch {
+	case fm.Deleted() && !q.IncludeDeleted:
+		return false
+	case q.State != "" && fm.ProcessingState != q.State:
+		return false
+	case !q.CreatedAfter.IsZero() && !fm.CreatedAt.After(q.CreatedAfter):
+		return false
+	case !q.CreatedBefore.IsZero() && !fm.CreatedAt.Before(q.CreatedBefore):
+		return false
+	case q.MinSize != nil && fm.Size < *q.MinSize:
+		return false
+	case q.MaxSize != nil && fm.Size > *q.MaxSize:
+		return false
+	case !strings.HasPrefix(fm.Filename, q.FilenamePrefix):
+		return false
+	}
+	return true
+}
+
+// compare orders records in the query's direction.
+func (q ListQuery) compare(a, b FileMetadata) int {
+	c := a.CreatedAt.Compare(b.CreatedAt)
+	if c == 0 {
+		c = strings.Compare(a.ID, b.ID)
+	}
+	if q.Descending {
+		return -c
+	}
+	return c
+}
+
+// afterCursor reports whether fm comes after the cursor position.
+func (q ListQuery) afterCursor(fm FileMetadata, c *listCursor) bool {
+	return c == nil || q.compare(fm, FileMetadata{ID: c.ID, CreatedAt: c.CreatedAt}) > 0
+}
+
+// listPage filters, sorts and pages items in memory. The local and memory
+// metadata stores list through it.
+func listPage(items []FileMetadata, q ListQuery) (*ListPage, error) {
+	cursor, err := decodeCursor(q.Cursor)
+
+	if err != nil {
+		return nil, err
+	}
+
+	page := []FileMetadata{}
+	for _, item := range items {
+		if q.matches(item) && q.afterCursor(item, cursor) {
+			page = append(page, item)
+		}
+	}
+
+	slices.SortFunc(page, q.compare)
+
+	return truncatePage(page, q.limit()), nil
+}
+
+// truncatePage cuts sorted items to limit, setting NextCursor when any were
+// left over.
+func truncatePage(items []FileMetadata, limit int) *ListPage {
+	if len(items) <= limit {
+		return &ListPage{Items: items}
+	}
+
+	items = items[:limit]
+	return &ListPage{Items: items, NextCursor: encodeCursor(items[limit-1])}
+}
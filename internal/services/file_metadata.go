@@ -0,0 +1,281 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+// Sha256IndexName is the GSI on the metadata table keyed by sha256.
+const Sha256IndexName = "Sha256Index"
+
+type FileMetadata struct {
+	ID              string    `dynamodbav:"id"`
+	Filename        string    `dynamodbav:"filename"`
+	Size            int64     `dynamodbav:"size"`
+	ProcessingState State     `dynamodbav:"processingState"`
+	CreatedAt       time.Time `dynamodbav:"createdAt"`
+	Sha256          string    `dynamodbav:"sha256,omitempty"`
+	ProcessedKey    string    `dynamodbav:"processedKey,omitempty"`
+	// ContentKey is the raw object holding the file's bytes when it is not
+	// the file's own raw/ key, as for uploads deduplicated by their declared
+	// sha256 that never stored a copy.
+	ContentKey string `dynamodbav:"contentKey,omitempty"`
+	// UploadID is the open multipart upload for a pending direct upload.
+	UploadID string `dynamodbav:"uploadId,omitempty"`
+	// UploadOffset and UploadParts track a resumable (tus) upload: the bytes
+	// received so far and the multipart parts they have been committed to.
+	UploadOffset int64           `dynamodbav:"uploadOffset,omitempty"`
+	UploadParts  []CompletedPart `dynamodbav:"uploadParts,omitempty"`
+	// UploadLease is held by the request appending to a resumable upload
+	// until UploadLeaseUntil, so no other request writes its parts.
+	UploadLease      string     `dynamodbav:"uploadLease,omitempty"`
+	UploadLeaseUntil *time.Time `dynamodbav:"uploadLeaseUntil,omitempty,unixtime"`
+	// DeletedAt marks a soft-deleted file. It is hidden from listings and
+	// purged for good once the grace period has passed.
+	DeletedAt *time.Time `dynamodbav:"deletedAt,omitempty"`
+	// TraceID follows the file from the upload request through processing.
+	TraceID string `dynamodbav:"traceId,omitempty"`
+
+	// UploadedAt, ProcessingAt, DoneAt, FailedAt and QuarantinedAt record
+	// when the file last entered each state; DeletedAt does so for deleted.
+	UploadedAt    *time.Time `dynamodbav:"uploadedAt,omitempty"`
+	ProcessingAt  *time.Time `dynamodbav:"processingAt,omitempty"`
+	DoneAt        *time.Time `dynamodbav:"doneAt,omitempty"`
+	FailedAt      *time.Time `dynamodbav:"failedAt,omitempty"`
+	QuarantinedAt *time.Time `dynamodbav:"quarantinedAt,omitempty"`
+	// Attempts counts the times processing has started.
+	Attempts int `dynamodbav:"attempts,omitempty"`
+	// LastError is why processing last failed or refused the file.
+	LastError string `dynamodbav:"lastError,omitempty"`
+	// RestoreState is the state a deleted file returns to when restored.
+	RestoreState State `dynamodbav:"restoreState,omitempty"`
+}
+
+// Deleted reports whether the file has been soft-deleted.
+func (fm FileMetadata) Deleted() bool {
+	return fm.DeletedAt != nil
+}
+
+// RawObjectKey returns the key of the raw object holding the file's bytes.
+func (fm FileMetadata) RawObjectKey() string {
+	if fm.ContentKey != "" {
+		return fm.ContentKey
+	}
+	return RawKey(fm.ID, fm.Filename)
+}
+
+// FindProcessed returns a processed file that has not been deleted and
+// whose content has the given sha256, or nil when there is none.
+func FindProcessed(ctx context.Context, store MetadataStore, sha256 string) (*FileMetadata, error) {
+	items, err := store.FindBySha256(ctx, sha256)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		if item.ProcessingState == StateDone && item.ProcessedKey != "" && !item.Deleted() {
+			return &item, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// FileUpdate lists the fields to change on an existing record. Nil fields are
+// left untouched.
+type FileUpdate struct {
+	// ProcessingState moves the record to a new state and dates it. It
+	// needs ExpectState, and the two must be a transition CanTransition
+	// allows.
+	ProcessingState *State
+	Sha256          *string
+	ProcessedKey    *string
+	Size            *int64
+	UploadID        *string
+	UploadOffset    *int64
+	UploadParts     []CompletedPart
+	// UploadLease releases the lease when set to "".
+	UploadLease      *string
+	UploadLeaseUntil *time.Time
+	DeletedAt        *time.Time
+	TraceID          *string
+	Attempts         *int
+	LastError        *string
+	RestoreState     *State
+	// Restore clears DeletedAt and RestoreState.
+	Restore bool
+
+	// ExpectState, when set, makes the update fail with ErrStateConflict
+	// unless the record is currently in that state.
+	ExpectState *State
+	// ExpectOffset does the same for UploadOffset, so concurrent appends to
+	// one resumable upload cannot both succeed.
+	ExpectOffset *int64
+	// ExpectLease requires the record to hold this upload lease, and
+	// ExpectLeaseFree requires it to hold none at the given time.
+	ExpectLease     *string
+	ExpectLeaseFree *time.Time
+	// ExpectDeleted requires the record to be soft-deleted (true) or not
+	// (false).
+	ExpectDeleted *bool
+}
+
+// attributes maps the set fields to their stored attribute names.
+func (u FileUpdate) attributes() map[string]any {
+	fields := map[string]any{}
+
+	if u.ProcessingState != nil {
+		fields["processingState"] = *u.ProcessingState
+	}
+	if u.Sha256 != nil {
+		fields["sha256"] = *u.Sha256
+	}
+	if u.ProcessedKey != nil {
+		fields["processedKey"] = *u.ProcessedKey
+	}
+	if u.Size != nil {
+		fields["size"] = *u.Size
+	}
+	if u.UploadID != nil {
+		fields["uploadId"] = *u.UploadID
+	}
+	if u.UploadOffset != nil {
+		fields["uploadOffset"] = *u.UploadOffset
+	}
+	if u.UploadParts != nil {
+		fields["uploadParts"] = u.UploadParts
+	}
+	if u.UploadLease != nil {
+		fields["uploadLease"] = *u.UploadLease
+	}
+	if u.UploadLeaseUntil != nil {
+		fields["uploadLeaseUntil"] = attributevalue.UnixTime(*u.UploadLeaseUntil)
+	}
+	if u.DeletedAt != nil {
+		fields["deletedAt"] = *u.DeletedAt
+	}
+	if u.TraceID != nil {
+		fields["traceId"] = *u.TraceID
+	}
+	if u.Attempts != nil {
+		fields["attempts"] = *u.Attempts
+	}
+	if u.LastError != nil {
+		fields["lastError"] = *u.LastError
+	}
+	if u.RestoreState != nil {
+		fields["restoreState"] = *u.RestoreState
+	}
+	// A restore returns to a state without re-entering it, and a time set
+	// explicitly, such as DeletedAt, is kept.
+	if u.ProcessingState != nil && !u.Restore {
+		if name := stateTimeAttribute(*u.ProcessingState); name != "" && fields[name] == nil {
+			fields[name] = time.Now().UTC()
+		}
+	}
+
+	return fields
+}
+
+// removals lists the stored attributes the update clears.
+func (u FileUpdate) removals() []string {
+	if u.Restore {
+		return []string{"deletedAt", "restoreState"}
+	}
+	return nil
+}
+
+// apply copies the set fields onto fm.
+func (u FileUpdate) apply(fm *FileMetadata) {
+	if u.ProcessingState != nil {
+		fm.ProcessingState = *u.ProcessingState
+	}
+	if u.Sha256 != nil {
+		fm.Sha256 = *u.Sha256
+	}
+	if u.ProcessedKey != nil {
+		fm.ProcessedKey = *u.ProcessedKey
+	}
+	if u.Size != nil {
+		fm.Size = *u.Size
+	}
+	if u.UploadID != nil {
+		fm.UploadID = *u.UploadID
+	}
+	if u.UploadOffset != nil {
+		fm.UploadOffset = *u.UploadOffset
+	}
+	if u.UploadParts != nil {
+		fm.UploadParts = u.UploadParts
+	}
+	if u.UploadLease != nil {
+		fm.UploadLease = *u.UploadLease
+	}
+	if u.UploadLeaseUntil != nil {
+		fm.UploadLeaseUntil = u.UploadLeaseUntil
+	}
+	if u.DeletedAt != nil {
+		fm.DeletedAt = u.DeletedAt
+	}
+	if u.TraceID != nil {
+		fm.TraceID = *u.TraceID
+	}
+	if u.Attempts != nil {
+		fm.Attempts = *u.Attempts
+	}
+	if u.LastError != nil {
+		fm.LastError = *u.LastError
+	}
+	if u.RestoreState != nil {
+		fm.RestoreState = *u.RestoreState
+	}
+	if u.ProcessingState != nil && !u.Restore && (*u.ProcessingState != StateDeleted || u.DeletedAt == nil) {
+		fm.setStateTime(*u.ProcessingState, time.Now().UTC())
+	}
+	if u.Restore {
+		fm.DeletedAt = nil
+		fm.RestoreState = ""
+	}
+}
+
+// validate rejects a state change the state machine does not allow.
+func (u FileUpdate) validate() error {
+	if u.ProcessingState == nil {
+		return nil
+	}
+	if u.ExpectState == nil || !CanTransition(*u.ExpectState, *u.ProcessingState) {
+		from := State("any state")
+		if u.ExpectState != nil {
+			from = *u.ExpectState
+		}
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, *u.ProcessingState)
+	}
+	return nil
+}
+
+// check reports whether fm satisfies the update's conditions.
+func (u FileUpdate) check(fm FileMetadata) error {
+	if err := u.validate(); err != nil {
+		return err
+	}
+	if u.ExpectState != nil && fm.ProcessingState != *u.ExpectState {
+		return fmt.Errorf("%w: file %s is %q, expected %q", ErrStateConflict, fm.ID, fm.ProcessingState, *u.ExpectState)
+	}
+	if u.ExpectOffset != nil && fm.UploadOffset != *u.ExpectOffset {
+		return fmt.Errorf("%w: file %s is at offset %d, expected %d", ErrStateConflict, fm.ID, fm.UploadOffset, *u.ExpectOffset)
+	}
+	if u.ExpectLease != nil && fm.UploadLease != *u.ExpectLease {
+		return fmt.Errorf("%w: file %s upload lease is no longer held", ErrStateConflict, fm.ID)
+	}
+	if u.ExpectLeaseFree != nil && fm.UploadLease != "" && fm.UploadLeaseUntil != nil && !fm.UploadLeaseUntil.Before(*u.ExpectLeaseFree) {
+		return fmt.Errorf("%w: file %s upload is leased until %s", ErrStateConflict, fm.ID, fm.UploadLeaseUntil)
+	}
+	if u.ExpectDeleted != nil && fm.Deleted() != *u.ExpectDeleted {
+		return fmt.Errorf("%w: file %s deleted is %t, expected %t", ErrStateConflict, fm.ID, fm.Deleted(), *u.ExpectDeleted)
+	}
+	return nil
+}
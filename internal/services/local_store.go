@@ -0,0 +1,292 @@
+package services
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalBlobStore keeps objects on the local filesystem, mirroring the bucket
+// layout (raw/..., processed/...) under root. Object metadata is kept in
+// sidecar files under root/.meta and in-progress multipart uploads under
+// root/.multipart, so neither shows up next to the content.
+type LocalBlobStore struct {
+	root string
+}
+
+type localObjectMeta struct {
+	ETag     string            `json:"etag"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory %s: %w", root, err)
+	}
+
+	return &LocalBlobStore{root: root}, nil
+}
+
+func (l *LocalBlobStore) PutObject(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	path, err := l.path(key)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("local upload failed: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+
+	if err != nil {
+		return fmt.Errorf("local upload failed: %w", err)
+	}
+
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), body)
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("local upload failed: %w", err)
+	}
+
+	meta := localObjectMeta{
+		ETag:     hex.EncodeToString(hash.Sum(nil)),
+		Metadata: metadata,
+	}
+
+	if err := l.writeMeta(key, meta); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("local upload failed: %w", err)
+	}
+
+	return nil
+}
+
+func (l *LocalBlobStore) GetObject(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	info, err := l.HeadObject(ctx, key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	path, _ := l.path(key)
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("local GetObject failed: %w", fsError(err))
+	}
+
+	return file, info, nil
+}
+
+func (l *LocalBlobStore) GetObjectRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	path, err := l.path(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("local GetObject failed: %w", fsError(err))
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, offset, length), file}, nil
+}
+
+func (l *LocalBlobStore) HeadObject(ctx context.Context, key string) (*ObjectInfo, error) {
+	path, err := l.path(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("local HeadObject failed: %w", fsError(err))
+	}
+
+	meta, err := l.readMeta(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ContentType:  contentTypeFor(key),
+		ETag:         meta.ETag,
+		LastModified: stat.ModTime().UTC(),
+		Metadata:     meta.Metadata,
+	}, nil
+}
+
+func (l *LocalBlobStore) DeleteObject(ctx context.Context, key string) error {
+	path, err := l.path(key)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("local DeleteObject failed: %w", err)
+	}
+
+	if err := os.Remove(l.metaPath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("local DeleteObject failed: %w", err)
+	}
+
+	return nil
+}
+
+// ListObjects walks root, leaving out the dot directories and the temporary
+// files of uploads still being written.
+func (l *LocalBlobStore) ListObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	err := filepath.WalkDir(l.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(l.root, path)
+
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+
+		if entry.IsDir() {
+			// Skip directories that cannot hold a key with the prefix.
+			if rel != "." && (strings.HasPrefix(entry.Name(), ".") || (!strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/"))) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasPrefix(key, prefix) || strings.HasPrefix(entry.Name(), ".upload-") {
+			return nil
+		}
+
+		stat, err := entry.Info()
+
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		meta, err := l.readMeta(key)
+
+		if err != nil {
+			return err
+		}
+
+		return fn(ObjectInfo{
+			Key:          key,
+			Size:         stat.Size(),
+			ContentType:  contentTypeFor(key),
+			ETag:         meta.ETag,
+			LastModified: stat.ModTime().UTC(),
+		})
+	})
+
+	if err != nil {
+		return fmt.Errorf("local ListObjects failed: %w", err)
+	}
+
+	return nil
+}
+
+// path resolves key to a file under root, rejecting keys that would escape it.
+func (l *LocalBlobStore) path(key string) (string, error) {
+	name := filepath.FromSlash(key)
+
+	// Top-level dot directories hold sidecar metadata and multipart parts.
+	if !filepath.IsLocal(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("%w: invalid object key %q", ErrValidation, key)
+	}
+
+	return filepath.Join(l.root, name), nil
+}
+
+func (l *LocalBlobStore) metaPath(key string) string {
+	return filepath.Join(l.root, ".meta", filepath.FromSlash(key)+".json")
+}
+
+func (l *LocalBlobStore) writeMeta(key string, meta localObjectMeta) error {
+	path := l.metaPath(key)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to write object metadata: %w", err)
+	}
+
+	data, err := json.Marshal(meta)
+
+	if err != nil {
+		return fmt.Errorf("failed to marshal object metadata: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write object metadata: %w", err)
+	}
+
+	return nil
+}
+
+func (l *LocalBlobStore) readMeta(key string) (localObjectMeta, error) {
+	var meta localObjectMeta
+	data, err := os.ReadFile(l.metaPath(key))
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return meta, nil
+	}
+
+	if err != nil {
+		return meta, fmt.Errorf("failed to read object metadata: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("failed to unmarshal object metadata: %w", err)
+	}
+
+	return meta, nil
+}
+
+// fsError tags a missing file as ErrNotFound.
+func fsError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return &kindError{kind: ErrNotFound, err: err}
+	}
+	return err
+}
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LogMetrics writes metrics to the request logger instead of publishing them,
+// for running without CloudWatch.
+type LogMetrics struct{}
+
+func NewLogMetrics() *LogMetrics {
+	return &LogMetrics{}
+}
+
+func (LogMetrics) EmitAsyncMetrics(ctx context.Context, endpoint string, status int, latency int, log *slog.Logger) {
+	log.Info("metric", slog.Group("metric",
+		"namespace", "FilePipeline/API",
+		"Endpoint", endpoint,
+		"StatusCode", status,
+		"RequestsCount", 1,
+		"RequestLatencyMs", latency,
+	))
+}
+
+func (LogMetrics) EmitAsyncFailure(ctx context.Context, endpoint string, log *slog.Logger) {
+	log.Info("metric", slog.Group("metric",
+		"namespace", "FilePipeline/API",
+		"Endpoint", endpoint,
+		"RequestFailures", 1,
+	))
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// idempotencySweepInterval is how often the local stores drop expired
+// records. Between sweeps an expired record is treated as absent.
+const idempotencySweepInterval = time.Minute
+
+// MemoryIdempotencyStore keeps idempotency records in process memory.
+// Expired records are dropped by a sweep run at most once per
+// idempotencySweepInterval, when a key is claimed.
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]IdempotencyRecord
+	sweptAt time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		records: map[string]IdempotencyRecord{},
+	}
+}
+
+func (m *MemoryIdempotencyStore) Claim(ctx context.Context, key, token string, expiresAt time.Time) (*IdempotencyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(m.sweptAt) >= idempotencySweepInterval {
+		for k, record := range m.records {
+			if !record.ExpiresAt.After(now) {
+				delete(m.records, k)
+			}
+		}
+		m.sweptAt = now
+	}
+
+	if record, ok := m.records[key]; ok && record.ExpiresAt.After(now) {
+		return &record, fmt.Errorf("%w: idempotency key %s is in use", ErrConflict, key)
+	}
+
+	m.records[key] = IdempotencyRecord{Key: key, Token: token, ExpiresAt: expiresAt}
+
+	return nil, nil
+}
+
+func (m *MemoryIdempotencyStore) Renew(ctx context.Context, key, token string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record, err := m.held(key, token)
+
+	if err != nil {
+		return err
+	}
+
+	record.ExpiresAt = expiresAt
+	m.records[key] = record
+
+	return nil
+}
+
+func (m *MemoryIdempotencyStore) Complete(ctx context.Context, record IdempotencyRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.held(record.Key, record.Token); err != nil {
+		return err
+	}
+
+	m.records[record.Key] = record
+
+	return nil
+}
+
+func (m *MemoryIdempotencyStore) Release(ctx context.Context, key, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.held(key, token); err != nil {
+		return err
+	}
+
+	delete(m.records, key)
+
+	return nil
+}
+
+// held returns the record for key if the claim made with token still holds
+// it. The caller must hold m.mu.
+func (m *MemoryIdempotencyStore) held(key, token string) (IdempotencyRecord, error) {
+	record, ok := m.records[key]
+
+	if !ok || record.Token != token {
+		return record, fmt.Errorf("%w: idempotency key %s is held by another request", ErrConflict, key)
+	}
+
+	return record, nil
+}
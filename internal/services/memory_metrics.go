@@ -0,0 +1,69 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"sync"
+)
+
+// EndpointMetrics aggregates what a MetricsRecorder has seen for one endpoint.
+type EndpointMetrics struct {
+	Requests       int
+	Failures       int
+	TotalLatencyMs int
+	// Statuses counts responses by status code.
+	Statuses map[int]int
+}
+
+// MemoryMetrics records metrics in process memory instead of publishing them.
+type MemoryMetrics struct {
+	mu        sync.Mutex
+	endpoints map[string]*EndpointMetrics
+}
+
+func NewMemoryMetrics() *MemoryMetrics {
+	return &MemoryMetrics{
+		endpoints: map[string]*EndpointMetrics{},
+	}
+}
+
+func (m *MemoryMetrics) EmitAsyncMetrics(ctx context.Context, endpoint string, status int, latency int, log *slog.Logger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.endpoint(endpoint)
+	e.Requests++
+	e.TotalLatencyMs += latency
+	e.Statuses[status]++
+}
+
+func (m *MemoryMetrics) EmitAsyncFailure(ctx context.Context, endpoint string, log *slog.Logger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.endpoint(endpoint).Failures++
+}
+
+// Snapshot returns a copy of the metrics recorded so far, keyed by endpoint.
+func (m *MemoryMetrics) Snapshot() map[string]EndpointMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[string]EndpointMetrics, len(m.endpoints))
+	for k, v := range m.endpoints {
+		e := *v
+		e.Statuses = maps.Clone(v.Statuses)
+		out[k] = e
+	}
+	return out
+}
+
+func (m *MemoryMetrics) endpoint(name string) *EndpointMetrics {
+	e, ok := m.endpoints[name]
+	if !ok {
+		e = &EndpointMetrics{Statuses: map[int]int{}}
+		m.endpoints[name] = e
+	}
+	return e
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+
+	"github.com/google/uuid"
+)
+
+type memoryUpload struct {
+	key      string
+	metadata map[string]string
+	parts    map[int32][]byte
+}
+
+func (m *MemoryBlobStore) CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	uploadID := uuid.NewString()
+	m.uploads[uploadID] = &memoryUpload{
+		key:      key,
+		metadata: maps.Clone(metadata),
+		parts:    map[int32][]byte{},
+	}
+
+	return uploadID, nil
+}
+
+func (m *MemoryBlobStore) UploadPart(ctx context.Context, key, uploadID string, partNumber int32, body io.ReadSeeker) (string, error) {
+	data, err := io.ReadAll(body)
+
+	if err != nil {
+		return "", fmt.Errorf("memory UploadPart %d failed: %w", partNumber, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, ok := m.uploads[uploadID]
+
+	if !ok || upload.key != key {
+		return "", fmt.Errorf("%w: multipart upload %s", ErrNotFound, uploadID)
+	}
+
+	upload.parts[partNumber] = data
+	sum := md5.Sum(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (m *MemoryBlobStore) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []CompletedPart) error {
+	m.mu.Lock()
+	upload, ok := m.uploads[uploadID]
+
+	if !ok || upload.key != key {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: multipart upload %s", ErrNotFound, uploadID)
+	}
+
+	delete(m.uploads, uploadID)
+	m.mu.Unlock()
+
+	readers := make([]io.Reader, 0, len(parts))
+	for _, part := range parts {
+		data, ok := upload.parts[part.PartNumber]
+		sum := md5.Sum(data)
+
+		if !ok || hex.EncodeToString(sum[:]) != part.ETag {
+			return fmt.Errorf("%w: multipart upload %s: invalid part %d", ErrValidation, uploadID, part.PartNumber)
+		}
+
+		readers = append(readers, bytes.NewReader(data))
+	}
+
+	return m.PutObject(ctx, key, io.MultiReader(readers...), upload.metadata)
+}
+
+func (m *MemoryBlobStore) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.uploads, uploadID)
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+// MemoryBlobStore keeps objects in process memory. Contents are lost on exit.
+type MemoryBlobStore struct {
+	mu      sync.RWMutex
+	objects map[string]*memoryObject
+	uploads map[string]*memoryUpload
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{
+		objects: map[string]*memoryObject{},
+		uploads: map[string]*memoryUpload{},
+	}
+}
+
+func (m *MemoryBlobStore) PutObject(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	data, err := io.ReadAll(body)
+
+	if err != nil {
+		return fmt.Errorf("memory upload failed: %w", err)
+	}
+
+	sum := md5.Sum(data)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.objects[key] = &memoryObject{
+		data: data,
+		info: ObjectInfo{
+			Key:          key,
+			Size:         int64(len(data)),
+			ContentType:  contentTypeFor(key),
+			ETag:         hex.EncodeToString(sum[:]),
+			LastModified: time.Now().UTC(),
+			Metadata:     maps.Clone(metadata),
+		},
+	}
+
+	return nil
+}
+
+func (m *MemoryBlobStore) GetObject(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[key]
+
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: object %s", ErrNotFound, key)
+	}
+
+	info := obj.info
+	info.Metadata = maps.Clone(obj.info.Metadata)
+
+	return io.NopCloser(bytes.NewReader(obj.data)), &info, nil
+}
+
+func (m *MemoryBlobStore) GetObjectRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[key]
+
+	if !ok {
+		return nil, fmt.Errorf("%w: object %s", ErrNotFound, key)
+	}
+
+	if offset < 0 || length < 0 || offset+length > int64(len(obj.data)) {
+		return nil, fmt.Errorf("%w: range %d+%d outside object %s", ErrValidation, offset, length, key)
+	}
+
+	return io.NopCloser(bytes.NewReader(obj.data[offset : offset+length])), nil
+}
+
+func (m *MemoryBlobStore) HeadObject(ctx context.Context, key string) (*ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[key]
+
+	if !ok {
+		return nil, fmt.Errorf("%w: object %s", ErrNotFound, key)
+	}
+
+	info := obj.info
+	info.Metadata = maps.Clone(obj.info.Metadata)
+
+	return &info, nil
+}
+
+func (m *MemoryBlobStore) DeleteObject(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.objects, key)
+
+	return nil
+}
+
+func (m *MemoryBlobStore) ListObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	m.mu.RLock()
+	infos := []ObjectInfo{}
+	for key, obj := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			info := obj.info
+			info.Metadata = nil
+			infos = append(infos, info)
+		}
+	}
+	m.mu.RUnlock()
+
+	// fn may call back into the store, so it runs without the lock.
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MemoryMetadataStore keeps FileMetadata records in process memory.
+type MemoryMetadataStore struct {
+	mu    sync.RWMutex
+	items map[string]FileMetadata
+}
+
+func NewMemoryMetadataStore() *MemoryMetadataStore {
+	return &MemoryMetadataStore{
+		items: map[string]FileMetadata{},
+	}
+}
+
+func (m *MemoryMetadataStore) GetAllItems(ctx context.Context) ([]FileMetadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	items := make([]FileMetadata, 0, len(m.items))
+	for _, item := range m.items {
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].CreatedAt.Before(items[j].CreatedAt)
+	})
+
+	return items, nil
+}
+
+func (m *MemoryMetadataStore) ListItems(ctx context.Context, query ListQuery) (*ListPage, error) {
+	items, err := m.GetAllItems(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return listPage(items, query)
+}
+
+func (m *MemoryMetadataStore) CreateItem(ctx context.Context, metadata *FileMetadata) error {
+	metadata.stampCreated()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.items[metadata.ID] = *metadata
+
+	return nil
+}
+
+func (m *MemoryMetadataStore) GetFileById(ctx context.Context, id string) (FileMetadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	item, ok := m.items[id]
+
+	if !ok {
+		return FileMetadata{}, fmt.Errorf("%w: file %s", ErrNotFound, id)
+	}
+
+	return item, nil
+}
+
+func (m *MemoryMetadataStore) UpdateItem(ctx context.Context, id string, update FileUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, ok := m.items[id]
+
+	if !ok {
+		return fmt.Errorf("%w: file %s", ErrNotFound, id)
+	}
+
+	if err := update.check(item); err != nil {
+		return err
+	}
+
+	update.apply(&item)
+	m.items[id] = item
+
+	return nil
+}
+
+func (m *MemoryMetadataStore) FindBySha256(ctx context.Context, sha256 string) ([]FileMetadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	items := []FileMetadata{}
+	for _, item := range m.items {
+		if item.Sha256 == sha256 {
+			items = append(items, item)
+		}
+	}
+
+	return items, nil
+}
+
+func (m *MemoryMetadataStore) DeleteItem(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.items, id)
+
+	return nil
+}
+
+func contentTypeFor(key string) string {
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,52 @@
+package services
+
+import "context"
+
+// transitionUnknown is the from state recorded for updates that do not say
+// which state they expect.
+const transitionUnknown = "unknown"
+
+// InstrumentedMetadataStore records processing-state transitions for every
+// record created or updated through it.
+type InstrumentedMetadataStore struct {
+	MetadataStore
+	metrics PipelineMetrics
+}
+
+func NewInstrumentedMetadataStore(store MetadataStore, metrics PipelineMetrics) *InstrumentedMetadataStore {
+	return &InstrumentedMetadataStore{MetadataStore: store, metrics: metrics}
+}
+
+func (s *InstrumentedMetadataStore) CreateItem(ctx context.Context, metadata *FileMetadata) error {
+	if err := s.MetadataStore.CreateItem(ctx, metadata); err != nil {
+		return err
+	}
+
+	s.metrics.RecordStateTransition("", string(metadata.ProcessingState))
+	return nil
+}
+
+func (s *InstrumentedMetadataStore) UpdateItem(ctx context.Context, id string, update FileUpdate) error {
+	if err := s.MetadataStore.UpdateItem(ctx, id, update); err != nil {
+		return err
+	}
+
+	if update.ProcessingState != nil {
+		from := transitionUnknown
+		if update.ExpectState != nil {
+			from = string(*update.ExpectState)
+		}
+
+		s.metrics.RecordStateTransition(from, string(*update.ProcessingState))
+	}
+	return nil
+}
+
+// CheckHealth checks the wrapped store, so wrapping it does not hide it from
+// readiness checks.
+func (s *InstrumentedMetadataStore) CheckHealth(ctx context.Context) error {
+	if checker, ok := s.MetadataStore.(HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// MultiMetrics sends every metric to several MetricsRecorders, so CloudWatch
+// and Prometheus can be used at the same time.
+type MultiMetrics struct {
+	recorders []MetricsRecorder
+}
+
+func NewMultiMetrics(recorders ...MetricsRecorder) *MultiMetrics {
+	return &MultiMetrics{recorders: recorders}
+}
+
+func (m *MultiMetrics) EmitAsyncMetrics(ctx context.Context, endpoint string, status int, latency int, log *slog.Logger) {
+	for _, r := range m.recorders {
+		r.EmitAsyncMetrics(ctx, endpoint, status, latency, log)
+	}
+}
+
+func (m *MultiMetrics) EmitAsyncFailure(ctx context.Context, endpoint string, log *slog.Logger) {
+	for _, r := range m.recorders {
+		r.EmitAsyncFailure(ctx, endpoint, log)
+	}
+}
+
+// RecordUploadBytes forwards to the recorders that implement PipelineMetrics.
+func (m *MultiMetrics) RecordUploadBytes(route string, bytes int64) {
+	for _, r := range m.recorders {
+		if p, ok := r.(PipelineMetrics); ok {
+			p.RecordUploadBytes(route, bytes)
+		}
+	}
+}
+
+// RecordStateTransition forwards to the recorders that implement
+// PipelineMetrics.
+func (m *MultiMetrics) RecordStateTransition(from, to string) {
+	for _, r := range m.recorders {
+		if p, ok := r.(PipelineMetrics); ok {
+			p.RecordStateTransition(from, to)
+		}
+	}
+}
+
+// Close closes the recorders that implement MetricsCloser.
+func (m *MultiMetrics) Close(ctx context.Context) error {
+	var errs []error
+	for _, r := range m.recorders {
+		if c, ok := r.(MetricsCloser); ok {
+			errs = append(errs, c.Close(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PrometheusMetrics exposes request, upload, processing and AWS call metrics
+// for scraping on /metrics. It records the same request metrics
+// CloudWatchService publishes.
+type PrometheusMetrics struct {
+	registry *prometheus.Registry
+
+	requests    *prometheus.CounterVec
+	latency     *prometheus.HistogramVec
+	failures    *prometheus.CounterVec
+	uploadBytes *prometheus.CounterVec
+	transitions *prometheus.CounterVec
+	awsLatency  *prometheus.HistogramVec
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests handled, by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency, by route, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_request_failures_total",
+			Help: "HTTP requests that ended with a 4xx or 5xx status, by route and method.",
+		}, []string{"route", "method"}),
+		uploadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "upload_bytes_total",
+			Help: "Request body bytes received, by route.",
+		}, []string{"route"}),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "processing_state_transitions_total",
+			Help: "File records moved between processing states.",
+		}, []string{"from", "to"}),
+		awsLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "aws_call_duration_seconds",
+			Help:    "AWS SDK call latency including retries, by service, operation and outcome.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"service", "operation", "outcome"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.latency, m.failures, m.uploadBytes, m.transitions, m.awsLatency,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Handler serves the registry in the Prometheus exposition format.
+func (m *PrometheusMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+func (m *PrometheusMetrics) EmitAsyncMetrics(ctx context.Context, endpoint string, status int, latency int, log *slog.Logger) {
+	method, route := splitEndpoint(endpoint)
+	code := strconv.Itoa(status)
+
+	m.requests.WithLabelValues(route, method, code).Inc()
+	m.latency.WithLabelValues(route, method, code).Observe(float64(latency) / 1000)
+}
+
+func (m *PrometheusMetrics) EmitAsyncFailure(ctx context.Context, endpoint string, log *slog.Logger) {
+	method, route := splitEndpoint(endpoint)
+
+	m.failures.WithLabelValues(route, method).Inc()
+}
+
+func (m *PrometheusMetrics) RecordUploadBytes(route string, bytes int64) {
+	m.uploadBytes.WithLabelValues(route).Add(float64(bytes))
+}
+
+func (m *PrometheusMetrics) RecordStateTransition(from, to string) {
+	m.transitions.WithLabelValues(from, to).Inc()
+}
+
+// AWSMiddleware times every SDK call made by a client it is added to through
+// the config's APIOptions.
+func (m *PrometheusMetrics) AWSMiddleware() func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("PrometheusLatency",
+			func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				start := time.Now()
+				out, metadata, err := next.HandleInitialize(ctx, in)
+
+				outcome := "ok"
+				if err != nil {
+					outcome = "error"
+				}
+
+				m.awsLatency.WithLabelValues(awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx), outcome).
+					Observe(time.Since(start).Seconds())
+
+				return out, metadata, err
+			}), middleware.Before)
+	}
+}
+
+// splitEndpoint splits the "METHOD /route" endpoint the metrics middleware
+// reports into its method and route.
+func splitEndpoint(endpoint string) (string, string) {
+	method, route, ok := strings.Cut(endpoint, " ")
+	if !ok {
+		return "", endpoint
+	}
+	return method, route
+}
@@ -0,0 +1,215 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// DefaultPartSize is comfortably above S3's 5 MiB minimum part size.
+	DefaultPartSize          = 8 << 20
+	DefaultUploadConcurrency = 4
+	// MaxUploadParts is S3's limit on parts per multipart upload.
+	MaxUploadParts = 10000
+)
+
+func (s *S3Service) CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error) {
+	res, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      &s.bucket,
+		Key:         &key,
+		ContentType: awssdk.String(contentTypeFor(key)),
+		Metadata:    metadata,
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("s3 CreateMultipartUpload failed: %w", awsError(err))
+	}
+
+	return awssdk.ToString(res.UploadId), nil
+}
+
+func (s *S3Service) UploadPart(ctx context.Context, key, uploadID string, partNumber int32, body io.ReadSeeker) (string, error) {
+	res, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     &s.bucket,
+		Key:        &key,
+		UploadId:   &uploadID,
+		PartNumber: &partNumber,
+		Body:       body,
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("s3 UploadPart %d failed: %w", partNumber, awsError(err))
+	}
+
+	return awssdk.ToString(res.ETag), nil
+}
+
+func (s *S3Service) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []CompletedPart) error {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, p := range parts {
+		completed = append(completed, types.CompletedPart{
+			PartNumber: awssdk.Int32(p.PartNumber),
+			ETag:       awssdk.String(p.ETag),
+		})
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return *completed[i].PartNumber < *completed[j].PartNumber
+	})
+
+	_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.bucket,
+		Key:             &key,
+		UploadId:        &uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+
+	if err != nil {
+		return fmt.Errorf("s3 CompleteMultipartUpload failed: %w", awsError(err))
+	}
+
+	return nil
+}
+
+func (s *S3Service) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &s.bucket,
+		Key:      &key,
+		UploadId: &uploadID,
+	})
+
+	if err != nil {
+		return fmt.Errorf("s3 AbortMultipartUpload failed: %w", awsError(err))
+	}
+
+	return nil
+}
+
+// putMultipart uploads first and the rest of body as parts of one multipart
+// upload. Buffers are recycled so no more than Concurrency parts are held at
+// once; reading the next part stalls until an in-flight part finishes. first
+// must come from partBuffer; every buffer goes back to the pool at the end.
+func (s *S3Service) putMultipart(ctx context.Context, key string, first []byte, body io.Reader, metadata map[string]string) error {
+	uploadID, err := s.CreateMultipartUpload(ctx, key, metadata)
+
+	if err != nil {
+		s.releaseBuffer(first)
+		return err
+	}
+
+	concurrency := max(s.Concurrency, 1)
+	free := make(chan []byte, concurrency)
+	allocated := 1
+
+	nextBuffer := func(ctx context.Context) ([]byte, error) {
+		select {
+		case buf := <-free:
+			return buf, nil
+		default:
+		}
+
+		if allocated < concurrency {
+			allocated++
+			return s.partBuffer(), nil
+		}
+
+		select {
+		case buf := <-free:
+			return buf, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var (
+		mu    sync.Mutex
+		parts []CompletedPart
+	)
+
+	g, gctx := errgroup.WithContext(ctx)
+	chunk := first
+	partNumber := int32(1)
+	var readErr error
+
+	for {
+		number, data := partNumber, chunk
+
+		g.Go(func() error {
+			defer func() { free <- data[:cap(data)] }()
+
+			etag, err := s.UploadPart(gctx, key, uploadID, number, bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			parts = append(parts, CompletedPart{PartNumber: number, ETag: etag})
+			mu.Unlock()
+			return nil
+		})
+
+		if len(chunk) < int(s.PartSize) {
+			break
+		}
+
+		buf, err := nextBuffer(gctx)
+		if err != nil {
+			break
+		}
+
+		n, err := io.ReadFull(body, buf)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil && err != io.ErrUnexpectedEOF {
+			readErr = fmt.Errorf("failed to read upload body: %w", err)
+			break
+		}
+
+		if partNumber == MaxUploadParts {
+			readErr = fmt.Errorf("upload exceeds %d parts of %d bytes", MaxUploadParts, s.PartSize)
+			break
+		}
+
+		chunk = buf[:n]
+		partNumber++
+	}
+
+	err = errors.Join(readErr, g.Wait())
+
+	// Every part has finished with its buffer. One read but never sent is
+	// left to the garbage collector.
+	for len(free) > 0 {
+		s.releaseBuffer(<-free)
+	}
+
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	if err == nil {
+		err = s.CompleteMultipartUpload(ctx, key, uploadID, parts)
+	}
+
+	if err != nil {
+		// The request context may already be cancelled; the abort must still run.
+		if abortErr := s.AbortMultipartUpload(context.WithoutCancel(ctx), key, uploadID); abortErr != nil {
+			err = errors.Join(err, abortErr)
+		}
+		return fmt.Errorf("s3 upload failed: %w", err)
+	}
+
+	return nil
+}
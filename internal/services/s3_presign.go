@@ -0,0 +1,81 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func (s *S3Service) PresignPutObject(ctx context.Context, key string, metadata map[string]string, expires time.Duration) (*PresignedRequest, error) {
+	req, err := s3.NewPresignClient(s.client).PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &s.bucket,
+		Key:         &key,
+		ContentType: awssdk.String(contentTypeFor(key)),
+		Metadata:    metadata,
+	}, s3.WithPresignExpires(expires))
+
+	if err != nil {
+		return nil, fmt.Errorf("s3 presign PutObject failed: %w", err)
+	}
+
+	return presignedRequest(req), nil
+}
+
+func (s *S3Service) PresignUploadPart(ctx context.Context, key, uploadID string, partNumber int32, expires time.Duration) (*PresignedRequest, error) {
+	req, err := s3.NewPresignClient(s.client).PresignUploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     &s.bucket,
+		Key:        &key,
+		UploadId:   &uploadID,
+		PartNumber: &partNumber,
+	}, s3.WithPresignExpires(expires))
+
+	if err != nil {
+		return nil, fmt.Errorf("s3 presign UploadPart %d failed: %w", partNumber, err)
+	}
+
+	return presignedRequest(req), nil
+}
+
+func (s *S3Service) PresignGetObject(ctx context.Context, key, filename string, expires time.Duration) (*PresignedRequest, error) {
+	input := &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	}
+
+	if filename != "" {
+		input.ResponseContentDisposition = awssdk.String(mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+
+	req, err := s3.NewPresignClient(s.client).PresignGetObject(ctx, input, s3.WithPresignExpires(expires))
+
+	if err != nil {
+		return nil, fmt.Errorf("s3 presign GetObject failed: %w", err)
+	}
+
+	return presignedRequest(req), nil
+}
+
+// presignedRequest keeps the signed headers a client has to send; Host is
+// implied by the URL.
+func presignedRequest(req *v4.PresignedHTTPRequest) *PresignedRequest {
+	headers := map[string]string{}
+	for name, values := range req.SignedHeader {
+		if strings.EqualFold(name, "Host") {
+			continue
+		}
+		headers[http.CanonicalHeaderKey(name)] = strings.Join(values, ",")
+	}
+
+	return &PresignedRequest{
+		Method:  req.Method,
+		URL:     req.URL,
+		Headers: headers,
+	}
+}
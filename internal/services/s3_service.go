@@ -1,52 +1,205 @@
 package services
 
 import (
+	"bytes"
 	"context"
 	"fmt"
-	"mime/multipart"
+	"io"
 	"s3-analytics/internal/aws"
+	"strings"
+	"sync"
 
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/google/uuid"
 )
 
 type S3Service struct {
-	client *s3.Client 
-	bucket string 
+	client *s3.Client
+	bucket string
+	// PartSize is the size of each multipart upload part and the largest
+	// body sent with a single PutObject.
+	PartSize int64
+	// Concurrency bounds the parts buffered and in flight per upload.
+	Concurrency int
+
+	// buffers recycles part buffers across uploads, so small uploads do
+	// not each allocate a whole part.
+	buffers sync.Pool
 }
 
 func NewS3Service(c *aws.S3Client) *S3Service {
 	return &S3Service{
-		client: c.Client,
-		bucket: c.Bucket,
+		client:      c.Client,
+		bucket:      c.Bucket,
+		PartSize:    DefaultPartSize,
+		Concurrency: DefaultUploadConcurrency,
 	}
 }
 
-func (s *S3Service) UploadFileToS3(ctx context.Context, fh *multipart.FileHeader, traceId string) (string, string, error) {
-	file, err := fh.Open()
+// PutObject streams body to S3. Bodies up to PartSize go up in one PutObject;
+// anything larger becomes a multipart upload that holds at most Concurrency
+// parts in memory and is aborted if any part fails.
+func (s *S3Service) PutObject(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	first := s.partBuffer()
+	n, err := io.ReadFull(body, first)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		defer s.releaseBuffer(first)
+		return s.putSingle(ctx, key, bytes.NewReader(first[:n]), metadata)
+	}
+
+	if err != nil {
+		s.releaseBuffer(first)
+		return fmt.Errorf("s3 upload failed: %w", err)
+	}
+
+	return s.putMultipart(ctx, key, first, body, metadata)
+}
+
+// partBuffer returns a PartSize buffer, reusing one from an earlier upload
+// when there is one.
+func (s *S3Service) partBuffer() []byte {
+	if buf, ok := s.buffers.Get().(*[]byte); ok && int64(len(*buf)) == s.PartSize {
+		return *buf
+	}
+	return make([]byte, s.PartSize)
+}
+
+// releaseBuffer returns a buffer from partBuffer for reuse. The caller must
+// be done with it.
+func (s *S3Service) releaseBuffer(buf []byte) {
+	buf = buf[:cap(buf)]
+	s.buffers.Put(&buf)
+}
+
+func (s *S3Service) putSingle(ctx context.Context, key string, body io.ReadSeeker, metadata map[string]string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &s.bucket,
+		Key:         &key,
+		Body:        body,
+		ContentType: awssdk.String(contentTypeFor(key)),
+		Metadata:    metadata,
+	})
 
 	if err != nil {
-		return "", "", fmt.Errorf("failed to open uploaded file: %w", err)
+		return fmt.Errorf("s3 upload failed: %w", awsError(err))
 	}
 
-	defer file.Close()
+	return nil
+}
+
+func (s *S3Service) GetObject(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	res, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
 
-	id := uuid.New().String()
-	key := fmt.Sprintf("raw/%s-%s", id, fh.Filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("s3 GetObject failed: %w", awsError(err))
+	}
 
+	info := &ObjectInfo{
+		Key:          key,
+		Size:         awssdk.ToInt64(res.ContentLength),
+		ContentType:  awssdk.ToString(res.ContentType),
+		ETag:         strings.Trim(awssdk.ToString(res.ETag), `"`),
+		LastModified: awssdk.ToTime(res.LastModified),
+		Metadata:     res.Metadata,
+	}
 
-	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+	return res.Body, info, nil
+}
+
+func (s *S3Service) GetObjectRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	res, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: &s.bucket,
-		Key: &key,
-		Body: file,
-		Metadata: map[string]string{
-			"trace_id" : traceId,
-		},
+		Key:    &key,
+		Range:  awssdk.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
 	})
 
 	if err != nil {
-		return "", "", fmt.Errorf("s3 upload failed: %w", err)
+		return nil, fmt.Errorf("s3 GetObject failed: %w", awsError(err))
 	}
 
-	return key, id, nil
-}
\ No newline at end of file
+	return res.Body, nil
+}
+
+func (s *S3Service) HeadObject(ctx context.Context, key string) (*ObjectInfo, error) {
+	res, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("s3 HeadObject failed: %w", awsError(err))
+	}
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         awssdk.ToInt64(res.ContentLength),
+		ContentType:  awssdk.ToString(res.ContentType),
+		ETag:         strings.Trim(awssdk.ToString(res.ETag), `"`),
+		LastModified: awssdk.ToTime(res.LastModified),
+		Metadata:     res.Metadata,
+	}, nil
+}
+
+func (s *S3Service) DeleteObject(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+
+	if err != nil {
+		return fmt.Errorf("s3 DeleteObject failed: %w", awsError(err))
+	}
+
+	return nil
+}
+
+// ListObjects pages through ListObjectsV2, so the whole listing is never
+// held in memory.
+func (s *S3Service) ListObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: &s.bucket,
+		Prefix: &prefix,
+	})
+
+	for paginator.HasMorePages() {
+		res, err := paginator.NextPage(ctx)
+
+		if err != nil {
+			return fmt.Errorf("s3 ListObjectsV2 failed: %w", awsError(err))
+		}
+
+		for _, object := range res.Contents {
+			key := awssdk.ToString(object.Key)
+
+			err := fn(ObjectInfo{
+				Key:          key,
+				Size:         awssdk.ToInt64(object.Size),
+				ContentType:  contentTypeFor(key),
+				ETag:         strings.Trim(awssdk.ToString(object.ETag), `"`),
+				LastModified: awssdk.ToTime(object.LastModified),
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// CheckHealth reports whether the bucket exists and is reachable.
+func (s *S3Service) CheckHealth(ctx context.Context) error {
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: &s.bucket,
+	})
+
+	if err != nil {
+		return fmt.Errorf("s3 HeadBucket failed: %w", awsError(err))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// State is the processing state of a FileMetadata record. Records move
+// only along these transitions, which every store's UpdateItem enforces with
+// a condition on the current state:
+//
+//	pending_upload → uploaded → processing → done | failed | quarantined
+//	pending_upload → processing, when the processor sees the object first
+//	failed → processing, to retry
+//	any state but processing → deleted → the state it was deleted from
+//
+// A file being processed cannot be deleted: the run's final transition would
+// fail and its output be lost, and a restore would leave the file in
+// processing with no run to finish it.
+type State string
+
+const (
+	// StatePendingUpload records are created before their content is
+	// stored and wait for the upload to complete.
+	StatePendingUpload State = "pending_upload"
+	// StateUploaded records have their content stored and wait for the
+	// processor.
+	StateUploaded State = "uploaded"
+	// StateProcessing records are being processed.
+	StateProcessing State = "processing"
+	StateDone       State = "done"
+	// StateFailed records failed processing; the processor retries them
+	// until their attempts run out.
+	StateFailed State = "failed"
+	// StateQuarantined records hold content the processor refused. They
+	// are not processed again.
+	StateQuarantined State = "quarantined"
+	// StateDeleted records are soft-deleted until restored or purged.
+	StateDeleted State = "deleted"
+)
+
+// ErrStateConflict is returned by UpdateItem when a FileUpdate condition
+// does not match the stored record.
+var ErrStateConflict = fmt.Errorf("%w: processing state does not match", ErrConflict)
+
+// ErrInvalidTransition is returned by UpdateItem for a state change the
+// state machine does not allow.
+var ErrInvalidTransition = fmt.Errorf("%w: invalid state transition", ErrValidation)
+
+// transitions lists the states each state may move to, apart from deleted
+// and back.
+var transitions = map[State][]State{
+	StatePendingUpload: {StateUploaded, StateProcessing},
+	StateUploaded:      {StateProcessing},
+	StateProcessing:    {StateDone, StateFailed, StateQuarantined},
+	StateFailed:        {StateProcessing},
+}
+
+// CanTransition reports whether a record may move from one state to
+// another.
+func CanTransition(from, to State) bool {
+	switch {
+	case from == to:
+		return false
+	case to == StateDeleted:
+		return from != StateDeleted && from != StateProcessing && from.Valid()
+	case from == StateDeleted:
+		return to != StateProcessing && to.Valid()
+	}
+	return slices.Contains(transitions[from], to)
+}
+
+// Valid reports whether s is one of the States.
+func (s State) Valid() bool {
+	return slices.Contains(States, s)
+}
+
+// Transition returns an update moving a record from one state to another.
+// It fails with ErrStateConflict unless the record is in from when the
+// update is applied.
+func Transition(from, to State) FileUpdate {
+	return FileUpdate{ProcessingState: &to, ExpectState: &from}
+}
+
+// stateTimeAttribute is the stored attribute recording when a record last
+// entered state, or "" for pending_upload.
+func stateTimeAttribute(state State) string {
+	switch state {
+	case StateUploaded:
+		return "uploadedAt"
+	case StateProcessing:
+		return "processingAt"
+	case StateDone:
+		return "doneAt"
+	case StateFailed:
+		return "failedAt"
+	case StateQuarantined:
+		return "quarantinedAt"
+	case StateDeleted:
+		return "deletedAt"
+	}
+	return ""
+}
+
+// StateTimes returns when the record last entered each state it has been
+// in, apart from pending_upload, which only a new record starts in.
+func (fm FileMetadata) StateTimes() map[State]time.Time {
+	times := map[State]time.Time{}
+
+	for state, at := range map[State]*time.Time{
+		StateUploaded:    fm.UploadedAt,
+		StateProcessing:  fm.ProcessingAt,
+		StateDone:        fm.DoneAt,
+		StateFailed:      fm.FailedAt,
+		StateQuarantined: fm.QuarantinedAt,
+		StateDeleted:     fm.DeletedAt,
+	} {
+		if at != nil {
+			times[state] = *at
+		}
+	}
+
+	return times
+}
+
+// setStateTime records that fm entered state at t.
+func (fm *FileMetadata) setStateTime(state State, t time.Time) {
+	switch state {
+	case StateUploaded:
+		fm.UploadedAt = &t
+	case StateProcessing:
+		fm.ProcessingAt = &t
+	case StateDone:
+		fm.DoneAt = &t
+	case StateFailed:
+		fm.FailedAt = &t
+	case StateQuarantined:
+		fm.QuarantinedAt = &t
+	case StateDeleted:
+		fm.DeletedAt = &t
+	}
+}
+
+// stampCreated dates a new record's initial state by its CreatedAt, unless
+// the caller already has.
+func (fm *FileMetadata) stampCreated() {
+	if _, ok := fm.StateTimes()[fm.ProcessingState]; !ok && fm.ProcessingState != StatePendingUpload {
+		fm.setStateTime(fm.ProcessingState, fm.CreatedAt)
+	}
+}
@@ -0,0 +1,257 @@
+// Backend-neutral interfaces for blob storage, file metadata and metrics.
+// The AWS-backed services implement them, as do the in-memory backends used
+// to run the API without a cloud account.
+
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"s3-analytics/internal/telemetry"
+	"time"
+)
+
+// ObjectInfo describes a stored object without its content.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+// BlobStore stores raw uploads and processed output by key.
+type BlobStore interface {
+	PutObject(ctx context.Context, key string, body io.Reader, metadata map[string]string) error
+	GetObject(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	// GetObjectRange reads length bytes starting at offset.
+	GetObjectRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	HeadObject(ctx context.Context, key string) (*ObjectInfo, error)
+	// DeleteObject removes key; deleting a missing key is not an error.
+	DeleteObject(ctx context.Context, key string) error
+}
+
+// ObjectLister is implemented by backends that can enumerate their objects.
+type ObjectLister interface {
+	// ListObjects calls fn for every object whose key starts with prefix.
+	// The ObjectInfo carries no Metadata. An error from fn stops the
+	// listing and is returned.
+	ListObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+// CompletedPart identifies an uploaded part when completing a multipart upload.
+type CompletedPart struct {
+	PartNumber int32  `json:"partNumber" dynamodbav:"partNumber"`
+	ETag       string `json:"etag" dynamodbav:"etag"`
+}
+
+// MultipartStore is implemented by backends that can assemble an object from
+// separately uploaded parts.
+type MultipartStore interface {
+	CreateMultipartUpload(ctx context.Context, key string, metadata map[string]string) (string, error)
+	UploadPart(ctx context.Context, key, uploadID string, partNumber int32, body io.ReadSeeker) (string, error)
+	CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []CompletedPart) error
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+}
+
+// PresignedRequest is a time-limited request a client can make directly
+// against the storage backend. Headers must be sent exactly as given.
+type PresignedRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Presigner is implemented by backends that can hand out presigned requests,
+// taking the API server off the data path.
+type Presigner interface {
+	PresignPutObject(ctx context.Context, key string, metadata map[string]string, expires time.Duration) (*PresignedRequest, error)
+	PresignUploadPart(ctx context.Context, key, uploadID string, partNumber int32, expires time.Duration) (*PresignedRequest, error)
+	// PresignGetObject signs a download; a non-empty filename is sent back
+	// as an attachment Content-Disposition.
+	PresignGetObject(ctx context.Context, key, filename string, expires time.Duration) (*PresignedRequest, error)
+}
+
+// MetadataStore persists FileMetadata records.
+type MetadataStore interface {
+	GetAllItems(ctx context.Context) ([]FileMetadata, error)
+	ListItems(ctx context.Context, query ListQuery) (*ListPage, error)
+	CreateItem(ctx context.Context, metadata *FileMetadata) error
+	GetFileById(ctx context.Context, id string) (FileMetadata, error)
+	// UpdateItem changes an existing record and fails if id does not exist.
+	UpdateItem(ctx context.Context, id string, update FileUpdate) error
+	FindBySha256(ctx context.Context, sha256 string) ([]FileMetadata, error)
+	DeleteItem(ctx context.Context, id string) error
+}
+
+// HealthChecker is implemented by stores that can tell whether their backend
+// is reachable. Stores without it are always considered ready.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// IdempotencyRecord is kept for a request made with an Idempotency-Key: the
+// fingerprint of its payload and, once it has succeeded, the response to
+// replay to retries. Token identifies the claim that wrote it.
+type IdempotencyRecord struct {
+	Key         string    `json:"key" dynamodbav:"idempotencyKey"`
+	Token       string    `json:"token,omitempty" dynamodbav:"token,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty" dynamodbav:"fingerprint,omitempty"`
+	StatusCode  int       `json:"statusCode,omitempty" dynamodbav:"statusCode,omitempty"`
+	Body        []byte    `json:"body,omitempty" dynamodbav:"body,omitempty"`
+	ExpiresAt   time.Time `json:"expiresAt" dynamodbav:"expiresAt,unixtime"`
+}
+
+// Completed reports whether the original request has finished and its
+// response can be replayed.
+func (r IdempotencyRecord) Completed() bool {
+	return r.StatusCode != 0
+}
+
+// IdempotencyStore remembers requests made with an Idempotency-Key until
+// their record expires.
+//
+// A claim is identified by the token it was made with. Renew, Complete and
+// Release fail with ErrConflict when key is no longer held by that token, so
+// a request whose lease ran out cannot overwrite or free a newer claim.
+type IdempotencyStore interface {
+	// Claim reserves key for a new request until expiresAt, a lease after
+	// which a retry may claim it again. If key is already held it returns
+	// the existing record along with ErrConflict.
+	Claim(ctx context.Context, key, token string, expiresAt time.Time) (*IdempotencyRecord, error)
+	// Renew extends the lease of a claim to expiresAt.
+	Renew(ctx context.Context, key, token string, expiresAt time.Time) error
+	// Complete stores the finished request's fingerprint and response
+	// until the record's ExpiresAt. record.Token must hold the key.
+	Complete(ctx context.Context, record IdempotencyRecord) error
+	// Release frees key after the request failed, so a retry runs again.
+	Release(ctx context.Context, key, token string) error
+}
+
+// UploadNotifier is told about new raw/ objects. The AWS deployment relies on
+// EventBridge instead, so it is optional.
+type UploadNotifier interface {
+	NotifyUploaded(ctx context.Context, key string)
+}
+
+// MetricsRecorder publishes request metrics without blocking the caller.
+// EmitAsyncMetrics is called for every request, EmitAsyncFailure in addition
+// for failed ones.
+type MetricsRecorder interface {
+	EmitAsyncMetrics(ctx context.Context, endpoint string, status int, latency int, log *slog.Logger)
+	EmitAsyncFailure(ctx context.Context, endpoint string, log *slog.Logger)
+}
+
+// MetricsCloser is implemented by MetricsRecorders that buffer metrics.
+// Close publishes whatever is still buffered and must be called on shutdown.
+type MetricsCloser interface {
+	Close(ctx context.Context) error
+}
+
+// PipelineMetrics is implemented by MetricsRecorders that also record upload
+// volume and processing-state transitions.
+type PipelineMetrics interface {
+	RecordUploadBytes(route string, bytes int64)
+	// RecordStateTransition counts a record moving between processing
+	// states. from is empty for new records.
+	RecordStateTransition(from, to string)
+}
+
+// RawKey returns the key a new upload is stored under: raw/<id>-<filename>.
+func RawKey(id, filename string) string {
+	return fmt.Sprintf("raw/%s-%s", id, filename)
+}
+
+// ObjectMetadata is the metadata stored on every raw object: the trace ID and
+// the span context, so the processor can continue the request's trace.
+func ObjectMetadata(ctx context.Context, traceId string) map[string]string {
+	metadata := map[string]string{"trace_id": traceId}
+	telemetry.Inject(ctx, metadata)
+	return metadata
+}
+
+// ResumableTailKey returns the key holding the bytes of a resumable upload
+// that do not yet fill a whole multipart part, as of the given offset. Each
+// offset gets its own key, so writing a new tail never clobbers the one the
+// committed offset still refers to.
+func ResumableTailKey(id string, offset int64) string {
+	return fmt.Sprintf("tus/%s-%d.part", id, offset)
+}
+
+// DeleteResumableTails removes the tail objects of a resumable upload. A
+// PATCH whose record update failed may have left tails at other offsets, so
+// every tail of the upload goes when storage can list them; otherwise only
+// the tail for offset does.
+func DeleteResumableTails(ctx context.Context, storage BlobStore, id string, offset int64) error {
+	lister, ok := storage.(ObjectLister)
+
+	if !ok {
+		return storage.DeleteObject(ctx, ResumableTailKey(id, offset))
+	}
+
+	return lister.ListObjects(ctx, fmt.Sprintf("tus/%s-", id), func(info ObjectInfo) error {
+		return storage.DeleteObject(ctx, info.Key)
+	})
+}
+
+// UploadResult describes an object written by UploadStream.
+type UploadResult struct {
+	ID     string
+	Key    string
+	Size   int64
+	Sha256 string
+}
+
+// UploadStream writes body under the raw/ key for id, computing its size
+// and sha256 on the way through so the content is only read once.
+func UploadStream(ctx context.Context, store BlobStore, id, filename string, body io.Reader, traceId string) (*UploadResult, error) {
+	key := RawKey(id, filename)
+	digest := NewDigestReader(body)
+
+	err := store.PutObject(ctx, key, digest, ObjectMetadata(ctx, traceId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &UploadResult{
+		ID:     id,
+		Key:    key,
+		Size:   digest.Size(),
+		Sha256: digest.Sha256(),
+	}, nil
+}
+
+// DigestReader hashes and counts everything read through it.
+type DigestReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func NewDigestReader(r io.Reader) *DigestReader {
+	return &DigestReader{r: r, hash: sha256.New()}
+}
+
+func (d *DigestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes read so far.
+func (d *DigestReader) Size() int64 {
+	return d.size
+}
+
+// Sha256 returns the hex sha256 of the bytes read so far.
+func (d *DigestReader) Sha256() string {
+	return hex.EncodeToString(d.hash.Sum(nil))
+}
@@ -0,0 +1,84 @@
+// Package telemetry configures OpenTelemetry tracing for the API and the
+// processor.
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// Span exporters selectable with TRACE_EXPORTER.
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends spans over OTLP/HTTP. The collector address comes
+	// from the standard OTEL_EXPORTER_OTLP_ENDPOINT variables and defaults to
+	// localhost:4318.
+	ExporterOTLP = "otlp"
+)
+
+// Tracer returns the tracer the service code starts spans with.
+var Tracer = otel.Tracer("s3-analytics")
+
+// Setup installs the global tracer provider and W3C propagator. The returned
+// TracerProvider must be shut down, or flushed after each Lambda
+// invocation, so buffered spans are exported. With ExporterNone spans are
+// still created, which keeps trace IDs flowing, but nothing is exported.
+func Setup(ctx context.Context, exporter, serviceName string) (*sdktrace.TracerProvider, error) {
+	options := []sdktrace.TracerProviderOption{}
+
+	switch exporter {
+	case ExporterNone, "":
+	case ExporterStdout:
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout span exporter: %w", err)
+		}
+
+		options = append(options, sdktrace.WithBatcher(exp))
+	case ExporterOTLP:
+		exp, err := otlptracehttp.New(ctx)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP span exporter: %w", err)
+		}
+
+		options = append(options, sdktrace.WithBatcher(exp))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(append(options, sdktrace.WithResource(res))...)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider, nil
+}
+
+// Inject adds the trace context in ctx to object metadata, so the processor
+// can continue the trace from the stored object.
+func Inject(ctx context.Context, metadata map[string]string) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(metadata))
+}
+
+// Extract returns ctx carrying the trace context stored in object metadata.
+func Extract(ctx context.Context, metadata map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(metadata))
+}